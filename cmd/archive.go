@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/adrian-bl/minisnap/lib/archive"
+	"github.com/adrian-bl/minisnap/lib/opts"
+)
+
+// archiveMain implements the 'archive' command.
+func archiveMain(g *globals, args []string) {
+	fl := g.flagSet("archive")
+	fl.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s archive restore [OPTION] dest\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "%s\n\n", commands["archive"].help)
+		fl.PrintDefaults()
+	}
+	dir := fl.String("dir", "", "archive directory to restore from")
+	vol := fl.String("volume", "", "restore from the archive configured for this volume instead of -dir")
+	snap := fl.String("snapshot", "", "snapshot to restore, e.g. 'daily@2020-01-02T00:00:00Z', defaults to the latest one")
+	if len(args) == 0 || args[0] != "restore" {
+		fl.Parse(args)
+		fl.Usage()
+		os.Exit(1)
+	}
+	fl.Parse(args[1:])
+
+	if (*dir == "") == (*vol == "") || fl.NArg() != 1 {
+		fl.Usage()
+		xfail("\nNeed either -dir or -volume and exactly one destination")
+	}
+
+	ao := &opts.Archive{Dir: *dir}
+	if *vol != "" {
+		vp, ok := g.config()[filepath.Clean(*vol)]
+		if !ok || vp.Options.Archive == nil {
+			xfail("volume %s: no archive defined in config", *vol)
+		}
+		ao = vp.Options.Archive
+	}
+
+	e := g.executor()
+	store, err := archive.Open(ao, e)
+	if err != nil {
+		xfail("failed to open archive: %v", err)
+	}
+	if err := archive.Restore(store, *snap, fl.Arg(0), e); err != nil {
+		xfail("restore failed: %v", err)
+	}
+}
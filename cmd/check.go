@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/adrian-bl/minisnap/lib/archive"
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/replicate"
+)
+
+// checker collects the problems found in a config file.
+type checker struct {
+	// files maps the paths of the config files to their content.
+	files  map[string][]byte
+	errors int
+	warns  int
+}
+
+// report prints a problem found at the given line of file. The position is omitted if file is empty, the line if 0.
+func (c *checker) report(warn bool, file string, line int, format string, args ...interface{}) {
+	kind := "error"
+	if warn {
+		kind = "warning"
+		c.warns++
+	} else {
+		c.errors++
+	}
+	msg := fmt.Sprintf("%s: %s", kind, fmt.Sprintf(format, args...))
+	switch {
+	case file == "":
+		fmt.Fprintf(os.Stderr, "%s\n", msg)
+	case line > 0:
+		fmt.Fprintf(os.Stderr, "%s: line %d: %s\n", file, line, msg)
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, msg)
+	}
+}
+
+// checkConfigMain implements the 'check-config' command.
+func checkConfigMain(g *globals, args []string) {
+	fl := g.flagSet("check-config")
+	fl.Parse(args)
+
+	c := &checker{files: make(map[string][]byte)}
+	files, err := readConfig(g.confFile, true)
+	var conf VolPolicy
+	if err == nil {
+		conf, err = decodeConfig(files)
+	}
+	if err != nil {
+		c.report(false, "", 0, "%v", err)
+		os.Exit(exitFailure)
+	}
+	for _, f := range files {
+		c.files[f.path] = f.pl
+	}
+
+	vols := make([]string, 0, len(conf))
+	for vol := range conf {
+		vols = append(vols, vol)
+	}
+	sort.Strings(vols)
+
+	// Datasets of ZFS volumes, used to find volumes covered by recursive snapshots of another one.
+	datasets := make(map[string]string)
+	for _, vol := range vols {
+		if ds := c.checkVolume(vol, conf[vol]); ds != "" {
+			datasets[vol] = ds
+		}
+	}
+	for _, vol := range vols {
+		if !conf[vol].Options.Recursive || datasets[vol] == "" {
+			continue
+		}
+		for _, other := range vols {
+			if strings.HasPrefix(datasets[other], datasets[vol]+"/") {
+				c.report(true, conf[other].File, c.line(conf[other]), "volume %s: dataset %s is also covered by the recursive snapshots of %s",
+					other, datasets[other], vol)
+			}
+		}
+	}
+
+	fmt.Printf("%s: %d files, %d targets, %d errors, %d warnings\n", g.confFile, len(files), len(conf), c.errors, c.warns)
+	if c.errors > 0 {
+		os.Exit(exitFailure)
+	}
+}
+
+// line returns the line at which the target of vp is defined in its config file.
+func (c *checker) line(vp *VolPolicyEntry) int {
+	return targetLine(c.files[vp.File], vp.Target)
+}
+
+// checkVolume checks the config of a single volume and returns its dataset if it is on ZFS.
+func (c *checker) checkVolume(vol string, vp *VolPolicyEntry) string {
+	pl, line := c.files[vp.File], c.line(vp)
+	keep := 0
+	for t, n := range vp.Schedule {
+		if n < 0 {
+			c.report(true, vp.File, keyLine(pl, line, t.String()), "volume %s: negative count %d for %s snapshots, none will be kept", vol, n, t)
+		}
+		if n > 0 {
+			keep += n
+		}
+	}
+	if keep == 0 {
+		c.report(true, vp.File, line, "volume %s: empty schedule, no snapshots will be created", vol)
+	}
+
+	fss, err := fs.ForVolume(vol, vp.Options, &exec.Exec{DryRun: true})
+	if err != nil {
+		c.report(false, vp.File, line, "volume %s: %v", vol, err)
+		return ""
+	}
+	e := &exec.Exec{DryRun: true}
+	if ro := vp.Options.Replicate; ro != nil {
+		if snd, ok := fss.(fs.Sender); !ok {
+			c.report(false, vp.File, keyLine(pl, line, "replicate"), "volume %s: %s does not support replication", vol, fss.Description())
+		} else if _, err := replicate.New(snd, ro, e); err != nil {
+			c.report(false, vp.File, keyLine(pl, line, "replicate"), "volume %s: %v", vol, err)
+		}
+	}
+	if ao := vp.Options.Archive; ao != nil {
+		if _, err := archive.Open(ao, e); err != nil {
+			c.report(false, vp.File, keyLine(pl, line, "archive"), "volume %s: %v", vol, err)
+		}
+	}
+
+	if z, ok := fss.(interface{ Dataset() string }); ok {
+		return z.Dataset()
+	}
+	return ""
+}
@@ -4,7 +4,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/zfs"
 	"github.com/adrian-bl/minisnap/lib/opts"
 	"github.com/adrian-bl/minisnap/lib/snapobj"
 
@@ -17,55 +23,488 @@ type VolPolicy map[string]*VolPolicyEntry
 type VolPolicyEntry struct {
 	Schedule map[snapobj.Type]int
 	Options  opts.VolOptions
+	// Target is the config key defining the volume, which differs from the volume for pattern targets.
+	Target string
+	// File is the config file defining the target.
+	File string
 }
 
 // yamlConfig is used to unmarshal the user config.
 type yamlConf struct {
-	Targets map[string]struct {
-		Schedule map[string]int
-		Options  opts.VolOptions
+	// Include lists patterns of drop-in files, only supported in the main config file.
+	Include globList `yaml:",omitempty"`
+	// ZFSProperties adds the datasets selected by the minisnap:schedule property as targets.
+	ZFSProperties bool `yaml:"zfs_properties,omitempty"`
+	// Defaults apply to all targets.
+	Defaults yamlTarget
+	// Profiles are referenced by targets and override the defaults.
+	Profiles map[string]yamlTarget
+	Targets  map[string]yamlTarget
+}
+
+// yamlTarget is the config of a single target.
+type yamlTarget struct {
+	Profile  string `yaml:",omitempty"`
+	Schedule map[string]int
+	Options  opts.VolOptions
+	// Exclude lists patterns of volumes not matched by a pattern target.
+	Exclude []string `yaml:",omitempty"`
+}
+
+// yamlRaw is the config before decoding the targets, used to merge them with their defaults and profile.
+type yamlRaw struct {
+	Defaults map[interface{}]interface{}
+	Profiles map[string]map[interface{}]interface{}
+	Targets  map[string]map[interface{}]interface{}
+}
+
+// globList is a list of glob patterns, which may also be given as a single string.
+type globList []string
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (gl *globList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*gl = globList{s}
+		return nil
+	}
+	var l []string
+	if err := unmarshal(&l); err != nil {
+		return err
 	}
+	*gl = l
+	return nil
 }
 
-// parseConfig converts the YAML encoded config at path and returns a volume policy.
+// confFile is a single file of the config.
+type confFile struct {
+	path string
+	pl   []byte
+	c    yamlConf
+	raw  yamlRaw
+}
+
+// parseConfig converts the YAML encoded config at path, including its drop-in files, and returns a volume policy.
 func parseConfig(path string) (VolPolicy, error) {
-	fh, err := os.Open(path)
+	files, err := readConfig(path, false)
 	if err != nil {
 		return nil, err
 	}
-	defer fh.Close()
+	return decodeConfig(files)
+}
+
+// dropIns returns the pattern of the default drop-in files of the config at path, e.g. '/etc/minisnap.d/*.conf'.
+func dropIns(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".d/*.conf"
+}
 
-	pl, err := ioutil.ReadAll(fh)
+// readConfig reads the config at path, followed by its drop-in files.
+// Drop-in files are given by the include patterns of the config, relative to its directory, and default to
+// the files matching dropIns. Files matching a pattern are read in lexical order.
+// In strict mode, unknown keys are reported as errors.
+func readConfig(path string, strict bool) ([]*confFile, error) {
+	main, err := readConfFile(path, strict)
 	if err != nil {
 		return nil, err
 	}
+	patterns := []string(main.c.Include)
+	if patterns == nil {
+		patterns = []string{dropIns(path)}
+	}
+
+	files := []*confFile{main}
+	seen := map[string]bool{filepath.Clean(path): true}
+	for _, p := range patterns {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include '%s': %v", path, p, err)
+		}
+		for _, m := range matches {
+			if seen[m] {
+				continue
+			}
+			seen[m] = true
+			f, err := readConfFile(m, strict)
+			if err != nil {
+				return nil, err
+			}
+			if f.c.Include != nil {
+				return nil, fmt.Errorf("%s: line %d: include is only supported in the main config file", m, keyLine(f.pl, 1, "include"))
+			}
+			if f.raw.Defaults != nil {
+				return nil, fmt.Errorf("%s: line %d: defaults are only supported in the main config file", m, keyLine(f.pl, 1, "defaults"))
+			}
+			if f.c.ZFSProperties {
+				return nil, fmt.Errorf("%s: line %d: zfs_properties is only supported in the main config file", m, keyLine(f.pl, 1, "zfs_properties"))
+			}
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
 
-	c := yamlConf{}
-	if err := yaml.Unmarshal(pl, &c); err != nil {
+// readConfFile reads and checks the single config file at path.
+func readConfFile(path string, strict bool) (*confFile, error) {
+	pl, err := ioutil.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
+	f := &confFile{path: path, pl: pl}
+	if err := f.decode(strict); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+// decode decodes the config file and checks its profiles and targets.
+func (f *confFile) decode(strict bool) error {
+	unmarshal := yaml.Unmarshal
+	if strict {
+		unmarshal = yaml.UnmarshalStrict
+	}
+	// Decode the config as given first, so errors refer to the lines of pl.
+	pl := f.pl
+	if err := unmarshal(pl, &f.c); err != nil {
+		return err
+	}
+	if f.c.Defaults.Profile != "" {
+		return fmt.Errorf("line %d: defaults can not use a profile", keyLine(pl, keyLine(pl, 1, "defaults"), "profile"))
+	}
+	if err := checkSchedule(pl, keyLine(pl, 1, "defaults"), "defaults", f.c.Defaults.Schedule); err != nil {
+		return err
+	}
+	for name, pr := range f.c.Profiles {
+		line := keyLine(pl, keyLine(pl, 1, "profiles"), name)
+		if pr.Profile != "" {
+			return fmt.Errorf("line %d: profile '%s' can not use another profile", line, name)
+		}
+		if err := checkSchedule(pl, line, fmt.Sprintf("Profile '%s'", name), pr.Schedule); err != nil {
+			return err
+		}
+	}
+	for k, tg := range f.c.Targets {
+		line := targetLine(pl, k)
+		if err := checkSchedule(pl, line, fmt.Sprintf("Volume '%s'", k), tg.Schedule); err != nil {
+			return err
+		}
+		if len(tg.Exclude) > 0 && !fs.IsPattern(k) {
+			return fmt.Errorf("line %d: Volume '%s': exclude is only supported for patterns", keyLine(pl, line, "exclude"), k)
+		}
+	}
+	return yaml.Unmarshal(pl, &f.raw)
+}
+
+// decodeConfig merges the config files read by readConfig into a volume policy.
+// Pattern targets and ZFS properties are expanded, so decoding the same files again picks up new volumes.
+// Patterns which fail to expand are skipped with a warning.
+// Explicit targets take precedence over ZFS properties, which take precedence over pattern targets.
+func decodeConfig(files []*confFile) (VolPolicy, error) {
+	defaults := files[0].raw.Defaults
+	profiles := make(map[string]*confFile)
+	targets := make(map[string]*confFile)
+	for _, f := range files {
+		for name := range f.c.Profiles {
+			if other, ok := profiles[name]; ok {
+				return nil, fmt.Errorf("Profile '%s' defined multiple times, in %s and %s", name, other.path, f.path)
+			}
+			profiles[name] = f
+		}
+		for k := range f.c.Targets {
+			if other, ok := targets[k]; ok {
+				return nil, fmt.Errorf("Volume '%s' defined multiple times, in %s and %s", k, other.path, f.path)
+			}
+			targets[k] = f
+		}
+	}
+
+	// Explicit targets are resolved first, so they take precedence over patterns matching the same volume.
+	keys := make([]string, 0, len(targets))
+	for k := range targets {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if fs.IsPattern(keys[i]) != fs.IsPattern(keys[j]) {
+			return !fs.IsPattern(keys[i])
+		}
+		return keys[i] < keys[j]
+	})
+
+	// Volumes opted in or out by ZFS properties, the latter with a nil entry.
+	props := make(VolPolicy)
+	if files[0].c.ZFSProperties {
+		var err error
+		if props, err = propertyTargets(defaults); err != nil {
+			return nil, err
+		}
+	}
 
 	vp := make(VolPolicy)
-	for k, tg := range c.Targets {
-		if _, ok := vp[k]; ok {
-			return nil, fmt.Errorf("Volume '%s' defined multiple times", k)
+	for _, k := range keys {
+		f := targets[k]
+		tg := f.c.Targets[k]
+		line := targetLine(f.pl, k)
+
+		// Later layers override earlier ones: defaults, profile, target.
+		m := defaults
+		if tg.Profile != "" {
+			pf, ok := profiles[tg.Profile]
+			if !ok {
+				return nil, fmt.Errorf("%s: line %d: Volume '%s': unknown profile '%s'", f.path, keyLine(f.pl, line, "profile"), k, tg.Profile)
+			}
+			m = merge(m, pf.raw.Profiles[tg.Profile])
+		}
+		m = merge(m, f.raw.Targets[k])
+		delete(m, "profile")
+		tg = yamlTarget{}
+		if err := remarshal(m, &tg); err != nil {
+			return nil, fmt.Errorf("%s: line %d: Volume '%s': %v", f.path, line, k, err)
 		}
 
-		vp[k] = &VolPolicyEntry{
+		ent := &VolPolicyEntry{
 			Schedule: make(map[snapobj.Type]int),
 			Options:  tg.Options,
+			Target:   k,
+			File:     f.path,
 		}
-
 		for t, v := range tg.Schedule {
 			st, err := snapobj.ToType(t)
 			if err != nil {
 				return nil, err
 			}
-			if _, ok := vp[k].Schedule[st]; ok {
-				return nil, fmt.Errorf("Volume '%s' defines target '%s' multiple times", k, st)
+			ent.Schedule[st] = v
+		}
+		if err := checkNaming(ent); err != nil {
+			return nil, fmt.Errorf("%s: line %d: Volume '%s': %v", f.path, keyLine(f.pl, line, "naming"), k, err)
+		}
+
+		if !fs.IsPattern(k) {
+			vp[k] = ent
+			continue
+		}
+		vols, err := fs.Expand(k, tg.Exclude)
+		if err != nil {
+			// Other targets must not suffer from a failing 'zfs list' or a broken pattern.
+			fmt.Fprintf(os.Stderr, "Warning: %s: line %d: Volume '%s': skipping pattern, failed to expand it: %v\n", f.path, line, k, err)
+			continue
+		}
+		for _, vol := range vols {
+			if _, ok := props[vol]; ok {
+				continue
 			}
-			vp[k].Schedule[st] = v
+			if other, ok := vp[vol]; ok {
+				if fs.IsPattern(other.Target) {
+					return nil, fmt.Errorf("Volume '%s' matched by patterns '%s' and '%s'", vol, other.Target, k)
+				}
+				continue
+			}
+			e := *ent
+			vp[vol] = &e
+		}
+	}
+	for vol, ent := range props {
+		if _, ok := vp[vol]; !ok && ent != nil {
+			vp[vol] = ent
+		}
+	}
+	return vp, nil
+}
+
+// propertyTargets returns the volumes of the datasets selected by the minisnap:schedule property, using the
+// options of defaults. The entries of datasets opting out are nil. Datasets without a mountpoint are skipped.
+func propertyTargets(defaults map[interface{}]interface{}) (VolPolicy, error) {
+	sd, err := zfs.ScheduledDatasets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s properties: %v", zfs.ScheduleProperty, err)
+	}
+	tg := yamlTarget{}
+	if err := remarshal(defaults, &tg); err != nil {
+		return nil, fmt.Errorf("defaults: %v", err)
+	}
+
+	vp := make(VolPolicy)
+	for _, d := range sd {
+		if !filepath.IsAbs(d.Mountpoint) {
+			continue
 		}
+		keep, err := zfs.ParseSchedule(d.Value)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %s: invalid %s '%s': %v", d.Dataset, zfs.ScheduleProperty, d.Value, err)
+		}
+		if keep == nil {
+			vp[d.Mountpoint] = nil
+			continue
+		}
+		// The property replaces the schedule of the defaults.
+		ent := &VolPolicyEntry{
+			Schedule: keep,
+			Options:  tg.Options,
+			Target:   fs.ZFSPrefix + d.Dataset,
+		}
+		if err := checkNaming(ent); err != nil {
+			return nil, fmt.Errorf("dataset %s: %v", d.Dataset, err)
+		}
+		vp[d.Mountpoint] = ent
 	}
 	return vp, nil
 }
+
+// dynamic returns true if the volumes of the config files depend on the system, i.e. decodeConfig might
+// return different volumes when called again.
+func dynamic(files []*confFile) bool {
+	if files[0].c.ZFSProperties {
+		return true
+	}
+	for _, f := range files {
+		for k := range f.c.Targets {
+			if fs.IsPattern(k) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkSchedule returns an error if schedule, defined at line of pl, contains unknown snapshot types.
+func checkSchedule(pl []byte, line int, where string, schedule map[string]int) error {
+	seen := make(map[snapobj.Type]bool)
+	for t := range schedule {
+		st, err := snapobj.ToType(t)
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %v '%s'", keyLine(pl, line, t), where, err, t)
+		}
+		if seen[st] {
+			return fmt.Errorf("%s defines target '%s' multiple times", where, st)
+		}
+		seen[st] = true
+	}
+	return nil
+}
+
+// checkNaming returns an error if the naming template of ent is invalid, or too coarse to tell its
+// scheduled snapshots apart.
+func checkNaming(ent *VolPolicyEntry) error {
+	if ent.Options.Naming == "" {
+		return nil
+	}
+	tmpl, err := snapobj.ParseTemplate(ent.Options.Naming)
+	if err != nil {
+		return err
+	}
+	for t, n := range ent.Schedule {
+		if n > 0 && tmpl.Resolution() > time.Duration(t)*time.Second {
+			return fmt.Errorf("naming template '%s' can not tell %s snapshots apart", tmpl, t)
+		}
+	}
+	return nil
+}
+
+// merge returns a copy of base with the values of over applied on top. Nested mappings are merged,
+// all other values of over replace the ones of base.
+func merge(base, over map[interface{}]interface{}) map[interface{}]interface{} {
+	m := make(map[interface{}]interface{})
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range over {
+		bm, bok := m[k].(map[interface{}]interface{})
+		om, ook := v.(map[interface{}]interface{})
+		if bok && ook {
+			m[k] = merge(bm, om)
+		} else {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// remarshal decodes the generic YAML mapping m into v.
+func remarshal(m map[interface{}]interface{}, v interface{}) error {
+	pl, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(pl, v)
+}
+
+// targetLine returns the line number at which the target vol is defined in the config pl, or 0 if not found.
+func targetLine(pl []byte, vol string) int {
+	return keyLine(pl, keyLine(pl, 1, "targets"), vol)
+}
+
+// keyLine returns the number of the first line at or after from which defines key in the YAML document pl.
+// It returns 0 if no such line exists. This is a textual search, as yaml.v2 does not expose node positions.
+func keyLine(pl []byte, from int, key string) int {
+	if from < 1 {
+		return 0
+	}
+	for i, l := range strings.Split(string(pl), "\n") {
+		if i+1 < from {
+			continue
+		}
+		l = strings.TrimSpace(l)
+		for _, k := range []string{key, "'" + key + "'", `"` + key + `"`} {
+			if strings.HasPrefix(l, k+":") {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// showConfigMain implements the 'show-config' command.
+func showConfigMain(g *globals, args []string) {
+	fl := g.flagSet("show-config")
+	fl.Parse(args)
+
+	conf := g.config()
+	vols := fl.Args()
+	if len(vols) == 0 {
+		for vol := range conf {
+			vols = append(vols, vol)
+		}
+	}
+
+	out := struct {
+		Targets map[string]yamlTarget
+	}{Targets: make(map[string]yamlTarget)}
+	for _, vol := range vols {
+		vp, ok := conf[filepath.Clean(vol)]
+		if !ok {
+			xfail("volume %s: not defined in config", vol)
+		}
+		tg := yamlTarget{Schedule: make(map[string]int), Options: redact(vp.Options)}
+		for st, n := range vp.Schedule {
+			tg.Schedule[st.String()] = n
+		}
+		out.Targets[filepath.Clean(vol)] = tg
+	}
+
+	pl, err := yaml.Marshal(out)
+	if err != nil {
+		xfail("%v", err)
+	}
+	os.Stdout.Write(pl)
+}
+
+// redacted replaces secrets printed by show-config.
+const redacted = "<redacted>"
+
+// redact returns a copy of o without the credentials of its S3 archive.
+func redact(o opts.VolOptions) opts.VolOptions {
+	if o.Archive == nil || o.Archive.S3 == nil {
+		return o
+	}
+	ao, s3 := *o.Archive, *o.Archive.S3
+	if s3.AccessKey != "" {
+		s3.AccessKey = redacted
+	}
+	if s3.SecretKey != "" {
+		s3.SecretKey = redacted
+	}
+	ao.S3 = &s3
+	o.Archive = &ao
+	return o
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/adrian-bl/minisnap/lib/opts"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+// testFiles decodes the given config files, the first being the main config.
+func testFiles(t *testing.T, configs ...string) []*confFile {
+	t.Helper()
+	var files []*confFile
+	for i, c := range configs {
+		f := &confFile{path: "test.conf", pl: []byte(c)}
+		if i > 0 {
+			f.path = "test.d/drop-in.conf"
+		}
+		if err := f.decode(true); err != nil {
+			t.Fatalf("decode(%s) = %v, want nil", f.path, err)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		desc string
+		base map[interface{}]interface{}
+		over map[interface{}]interface{}
+		want map[interface{}]interface{}
+	}{
+		{
+			desc: "nil base",
+			over: map[interface{}]interface{}{"a": 1},
+			want: map[interface{}]interface{}{"a": 1},
+		},
+		{
+			desc: "override",
+			base: map[interface{}]interface{}{"a": 1, "b": 2},
+			over: map[interface{}]interface{}{"b": 3},
+			want: map[interface{}]interface{}{"a": 1, "b": 3},
+		},
+		{
+			desc: "nested mappings",
+			base: map[interface{}]interface{}{"options": map[interface{}]interface{}{"recursive": true, "readonly": true}},
+			over: map[interface{}]interface{}{"options": map[interface{}]interface{}{"readonly": false}},
+			want: map[interface{}]interface{}{"options": map[interface{}]interface{}{"recursive": true, "readonly": false}},
+		},
+		{
+			desc: "lists are replaced",
+			base: map[interface{}]interface{}{"adopt": []interface{}{"sanoid"}},
+			over: map[interface{}]interface{}{"adopt": []interface{}{"zfs-auto-snapshot"}},
+			want: map[interface{}]interface{}{"adopt": []interface{}{"zfs-auto-snapshot"}},
+		},
+		{
+			desc: "mapping replaces scalar",
+			base: map[interface{}]interface{}{"a": 1},
+			over: map[interface{}]interface{}{"a": map[interface{}]interface{}{"b": 2}},
+			want: map[interface{}]interface{}{"a": map[interface{}]interface{}{"b": 2}},
+		},
+	}
+	for _, tt := range tests {
+		base := merge(nil, tt.base)
+		got := merge(tt.base, tt.over)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: merge() mismatch (-want +got)\n%s", tt.desc, diff)
+		}
+		if diff := cmp.Diff(base, merge(nil, tt.base)); diff != "" {
+			t.Errorf("%s: merge() modified base (-before +after)\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	const main = `
+defaults:
+  schedule:
+    hourly: 24
+    daily: 7
+  options:
+    readonly: true
+    replicate:
+      target: ssh://backup/tank
+      compress: zstd
+profiles:
+  vm:
+    schedule:
+      hourly: 48
+    options:
+      replicate:
+        compress: lz4
+targets:
+  /tank/plain:
+  /tank/vm:
+    profile: vm
+  /tank/own:
+    profile: vm
+    schedule:
+      daily: 30
+    options:
+      readonly: false
+      replicate:
+        rate_limit: 10M
+`
+	const dropIn = `
+profiles:
+  db:
+    schedule:
+      minutely: 60
+targets:
+  /srv/db:
+    profile: db
+  /srv/vm:
+    profile: vm
+`
+	files := testFiles(t, main, dropIn)
+	got, err := decodeConfig(files)
+	if err != nil {
+		t.Fatalf("decodeConfig() = _, %v, want nil", err)
+	}
+
+	want := VolPolicy{
+		"/tank/plain": {
+			Schedule: map[snapobj.Type]int{snapobj.Hourly: 24, snapobj.Daily: 7},
+			Options:  opts.VolOptions{ReadOnly: true, Replicate: &opts.Replicate{Target: "ssh://backup/tank", Compress: "zstd"}},
+			Target:   "/tank/plain",
+			File:     "test.conf",
+		},
+		// The profile overrides the defaults.
+		"/tank/vm": {
+			Schedule: map[snapobj.Type]int{snapobj.Hourly: 48, snapobj.Daily: 7},
+			Options:  opts.VolOptions{ReadOnly: true, Replicate: &opts.Replicate{Target: "ssh://backup/tank", Compress: "lz4"}},
+			Target:   "/tank/vm",
+			File:     "test.conf",
+		},
+		// The target overrides its profile and the defaults.
+		"/tank/own": {
+			Schedule: map[snapobj.Type]int{snapobj.Hourly: 48, snapobj.Daily: 30},
+			Options:  opts.VolOptions{Replicate: &opts.Replicate{Target: "ssh://backup/tank", Compress: "lz4", RateLimit: "10M"}},
+			Target:   "/tank/own",
+			File:     "test.conf",
+		},
+		// Drop-in files use the defaults of the main config and profiles of any file.
+		"/srv/db": {
+			Schedule: map[snapobj.Type]int{snapobj.Minutely: 60, snapobj.Hourly: 24, snapobj.Daily: 7},
+			Options:  opts.VolOptions{ReadOnly: true, Replicate: &opts.Replicate{Target: "ssh://backup/tank", Compress: "zstd"}},
+			Target:   "/srv/db",
+			File:     "test.d/drop-in.conf",
+		},
+		"/srv/vm": {
+			Schedule: map[snapobj.Type]int{snapobj.Hourly: 48, snapobj.Daily: 7},
+			Options:  opts.VolOptions{ReadOnly: true, Replicate: &opts.Replicate{Target: "ssh://backup/tank", Compress: "lz4"}},
+			Target:   "/srv/vm",
+			File:     "test.d/drop-in.conf",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("decodeConfig() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestDecodeConfigInvalid(t *testing.T) {
+	tests := []struct {
+		desc    string
+		configs []string
+		wantErr string
+	}{
+		{
+			desc: "unknown profile",
+			configs: []string{`
+targets:
+  /tank:
+    profile: missing
+`},
+			wantErr: "test.conf: line 4: Volume '/tank': unknown profile 'missing'",
+		},
+		{
+			desc: "profile defined in two files",
+			configs: []string{`
+profiles:
+  vm:
+    schedule:
+      hourly: 1
+`, `
+profiles:
+  vm:
+    schedule:
+      daily: 1
+`},
+			wantErr: "Profile 'vm' defined multiple times",
+		},
+		{
+			desc: "target defined in two files",
+			configs: []string{`
+targets:
+  /tank:
+`, `
+targets:
+  /tank:
+`},
+			wantErr: "Volume '/tank' defined multiple times",
+		},
+		{
+			desc: "naming of defaults too coarse for target",
+			configs: []string{`
+defaults:
+  options:
+    naming: '{type}-{2006-01-02_15}'
+targets:
+  /tank:
+    schedule:
+      minutely: 60
+`},
+			wantErr: "Volume '/tank': naming template '{type}-{2006-01-02_15}' can not tell minutely snapshots apart",
+		},
+	}
+	for _, tt := range tests {
+		_, err := decodeConfig(testFiles(t, tt.configs...))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: decodeConfig() = _, %v, want error containing %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	o := opts.VolOptions{Archive: &opts.Archive{S3: &opts.S3{Bucket: "b", AccessKey: "AKID", SecretKey: "secret"}}}
+	got := redact(o)
+	want := opts.VolOptions{Archive: &opts.Archive{S3: &opts.S3{Bucket: "b", AccessKey: redacted, SecretKey: redacted}}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("redact() mismatch (-want +got)\n%s", diff)
+	}
+	if o.Archive.S3.SecretKey != "secret" {
+		t.Errorf("redact() modified its argument")
+	}
+	// Keys taken from the environment are not part of the config.
+	o = opts.VolOptions{Archive: &opts.Archive{S3: &opts.S3{Bucket: "b"}}}
+	if diff := cmp.Diff(o, redact(o)); diff != "" {
+		t.Errorf("redact() without keys mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestDecodeConfigPatterns(t *testing.T) {
+	files := testFiles(t, `
+targets:
+  /tank/explicit:
+    schedule:
+      daily: 7
+`, `
+targets:
+  /nonexistent/msnap/*:
+    schedule:
+      hourly: 24
+  /tank/[:
+    schedule:
+      hourly: 24
+`)
+	got, err := decodeConfig(files)
+	if err != nil {
+		t.Fatalf("decodeConfig() = _, %v, want nil", err)
+	}
+	// Neither the pattern matching nothing nor the broken one affects the explicit target.
+	if diff := cmp.Diff([]string{"/tank/explicit"}, policyVolumes(got)); diff != "" {
+		t.Errorf("decodeConfig() volumes mismatch (-want +got)\n%s", diff)
+	}
+	// The pattern matching nothing must be expanded again later, to pick up new volumes.
+	if !dynamic(files) {
+		t.Errorf("dynamic() = false, want true")
+	}
+	if dynamic(files[:1]) {
+		t.Errorf("dynamic() of explicit targets = true, want false")
+	}
+}
+
+// policyVolumes returns the sorted volumes of vp.
+func policyVolumes(vp VolPolicy) []string {
+	var vols []string
+	for vol := range vp {
+		vols = append(vols, vol)
+	}
+	sort.Strings(vols)
+	return vols
+}
+
+func TestDecodeConfigSchedule(t *testing.T) {
+	files := testFiles(t, `
+defaults:
+  schedule:
+    hourly: 24
+    daily: 7
+profiles:
+  workstation:
+    schedule:
+      minutely: 10
+targets:
+  /inherit:
+    profile: workstation
+    schedule:
+      daily: 30
+  /drop:
+    profile: workstation
+    schedule:
+      hourly: 0
+      minutely: 0
+`)
+	got, err := decodeConfig(files)
+	if err != nil {
+		t.Fatalf("decodeConfig() = _, %v, want nil", err)
+	}
+	want := map[string]map[snapobj.Type]int{
+		// Types left out of the schedule of a target are inherited.
+		"/inherit": {snapobj.Minutely: 10, snapobj.Hourly: 24, snapobj.Daily: 30},
+		// Only a count of zero drops an inherited type.
+		"/drop": {snapobj.Minutely: 0, snapobj.Hourly: 0, snapobj.Daily: 7},
+	}
+	for vol, w := range want {
+		if diff := cmp.Diff(w, got[vol].Schedule); diff != "" {
+			t.Errorf("decodeConfig() schedule of %s mismatch (-want +got)\n%s", vol, diff)
+		}
+	}
+	if c := calendar(got["/drop"].Schedule); c != "hourly" {
+		t.Errorf("calendar() of dropped types = %q, want %q", c, "hourly")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/policy"
+)
+
+const (
+	// maxSleep bounds the time the daemon sleeps, so it notices volumes which were mounted in the meantime.
+	maxSleep = 15 * time.Minute
+	// retryInterval is the time after which a failed volume is retried.
+	retryInterval = time.Minute
+)
+
+// daemonMain implements the 'daemon' command.
+func daemonMain(g *globals, args []string) {
+	fl := g.flagSet("daemon")
+	parallel := fl.Int("parallel", 1, "number of volumes to process concurrently")
+	serialize := fl.Bool("serialize_pools", false, "with -parallel, process volumes on the same pool one after another")
+	fl.Parse(args)
+
+	files, err := readConfig(g.confFile, false)
+	if err != nil {
+		xfail("failed to parse config: %v", err)
+	}
+	conf, err := decodeConfig(files)
+	if err != nil {
+		xfail("failed to parse config: %v", err)
+	}
+	if *parallel < 1 {
+		xfail("-parallel must be at least 1")
+	}
+
+	// Messages must not end up within the JSON output.
+	msg := os.Stdout
+	if g.json {
+		msg = os.Stderr
+	}
+
+	// SIGTERM lets the volumes being worked on finish their create phase, a second one kills us.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	stop := make(chan struct{})
+	reload := make(chan struct{}, 1)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			fmt.Fprintf(msg, "Received %v, shutting down\n", sig)
+			signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+			close(stop)
+			return
+		}
+	}()
+
+	rn := &runner{g: g, ph: phaseAll, parallel: *parallel, serialize: *serialize, stop: stop}
+	notBefore := make(map[string]time.Time)
+	for {
+		now := time.Now()
+		due, next := dueVolumes(conf, volumes(fl, fl.NArg() == 0, conf), notBefore, now)
+		if len(due) > 0 {
+			results := rn.run(conf, due)
+			printSummary(results, g.json)
+			for _, r := range results {
+				// Dry runs never create the due snapshots.
+				if r.err != nil || g.dryRun {
+					notBefore[r.vol] = now.Add(retryInterval)
+				} else {
+					delete(notBefore, r.vol)
+				}
+			}
+			if stopped(stop) {
+				return
+			}
+			continue
+		}
+
+		if g.verbose {
+			fmt.Fprintf(msg, "Sleeping until %s\n", next.Format(time.RFC3339))
+		}
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-t.C:
+			// Expand pattern targets and ZFS properties again to pick up new volumes, without reloading the config.
+			if !dynamic(files) {
+				break
+			}
+			nc, err := decodeConfig(files)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to expand targets, keeping the current volumes: %v\n", err)
+				break
+			}
+			conf = nc
+		case <-reload:
+			nf, err := readConfig(g.confFile, false)
+			var nc VolPolicy
+			if err == nil {
+				nc, err = decodeConfig(nf)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to reload '%s', keeping the current config: %v\n", g.confFile, err)
+				break
+			}
+			fmt.Fprintf(msg, "Reloaded %s\n", g.confFile)
+			files, conf = nf, nc
+		case <-stop:
+			return
+		}
+		t.Stop()
+	}
+}
+
+// dueVolumes returns the volumes with due snapshots and the time at which the next volume becomes due.
+// Volumes are not due before the time given in notBefore.
+func dueVolumes(conf VolPolicy, vols []string, notBefore map[string]time.Time, now time.Time) ([]string, time.Time) {
+	var due []string
+	next := now.Add(maxSleep)
+	for _, vol := range vols {
+		n, err := nextRun(conf, vol, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "volume %s: %v, retrying in %v\n", vol, err, retryInterval)
+			n = now.Add(retryInterval)
+		}
+		if n.IsZero() {
+			continue
+		}
+		if nb, ok := notBefore[vol]; ok && nb.After(n) {
+			n = nb
+		}
+		if !n.After(now) {
+			due = append(due, vol)
+		} else if n.Before(next) {
+			next = n
+		}
+	}
+	return due, next
+}
+
+// nextRun returns the time at which vol needs to be processed next, or the zero time if never.
+func nextRun(conf VolPolicy, vol string, now time.Time) (time.Time, error) {
+	vp, ok := conf[vol]
+	if !ok {
+		return time.Time{}, fmt.Errorf("not defined in config")
+	}
+	fss, err := fs.ForVolume(vol, vp.Options, &exec.Exec{DryRun: true})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to open volume: %v", err)
+	}
+	cur, err := fss.Gather()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to gather current snapshots: %v", err)
+	}
+	p := &policy.Policy{Now: now, Keep: vp.Schedule}
+	return p.Next(cur), nil
+}
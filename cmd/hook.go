@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// hookLockTimeout is the default time a hook waits for the locks held by a run, instead of skipping its snapshot.
+const hookLockTimeout = 10 * time.Minute
+
+// hookMain implements the 'hook' command.
+func hookMain(g *globals, args []string) {
+	fl := g.flagSet("hook")
+	tool := fl.String("tool", "", "package manager running the hook, e.g. 'apt', 'dnf' or 'pacman'")
+	command := fl.String("command", "", "command line of the package manager, found in the parent processes if empty")
+	fl.Parse(args)
+
+	if fl.NArg() < 1 || (fl.Arg(0) != "pre" && fl.Arg(0) != "post") {
+		fl.Usage()
+		xfail("\nWant 'pre' or 'post'")
+	}
+	when := fl.Arg(0)
+	if *tool == "" {
+		xfail("-tool is required")
+	}
+	if !flagGiven(fl, "lock_timeout") {
+		g.lockTimeout = hookLockTimeout
+	}
+
+	conf := g.config()
+	var vols []string
+	if fl.NArg() > 1 {
+		for _, vol := range fl.Args()[1:] {
+			vols = append(vols, filepath.Clean(vol))
+		}
+	} else {
+		for vol, vp := range conf {
+			if vp.Options.Hooks != nil {
+				vols = append(vols, vol)
+			}
+		}
+		sort.Strings(vols)
+	}
+	if len(vols) == 0 {
+		xfail("no volumes given and none configured with 'hooks'")
+	}
+
+	so, err := snapobj.NewManual(*tool+"-"+when, time.Now(), 0)
+	if err != nil {
+		xfail("invalid -tool: %v", err)
+	}
+	if *command == "" {
+		*command = parentCommand(*tool)
+	}
+	if *command == "" {
+		*command = commandLine()
+	}
+	so.Meta = newMeta(*command)
+	hp := &hookPair{tool: *tool, post: when == "post", id: so.Epoch.UTC().Format(time.RFC3339Nano)}
+
+	results := createManual(g, conf, vols, so, hp)
+	// A failing hook may abort the transaction, so only report problems.
+	if code := exitCode(results); code != 0 {
+		printSummary(results, g.json)
+		for _, r := range results {
+			if r.err != nil {
+				fmt.Fprintf(os.Stderr, "Error: no %s snapshot of volume %s: %v\n", so.Label, r.vol, r.err)
+			}
+		}
+		os.Exit(code)
+	}
+}
+
+// hookPair links the snapshots taken before and after the same transaction of a package manager.
+type hookPair struct {
+	tool string
+	// post is set for the snapshot taken after the transaction.
+	post bool
+	// id is the pair id of the snapshot unless it joins the pair of a pre snapshot.
+	id string
+}
+
+// label returns the label of the snapshots taken before or after transactions of the tool.
+func (hp *hookPair) label(post bool) string {
+	if post {
+		return hp.tool + "-post"
+	}
+	return hp.tool + "-pre"
+}
+
+// link returns a copy of so carrying its pair id. A pre snapshot starts a new pair, a post snapshot joins the
+// pair of the newest pre snapshot in cur, unless that pair is complete already, e.g. as its pre hook failed.
+func (hp *hookPair) link(so *snapobj.SnapObj, cur []*snapobj.SnapObj) *snapobj.SnapObj {
+	c := *so
+	c.Meta = make(map[string]string, len(so.Meta)+1)
+	for k, v := range so.Meta {
+		c.Meta[k] = v
+	}
+	c.Meta[snapobj.MetaPair] = hp.id
+	if !hp.post {
+		return &c
+	}
+
+	var pre *snapobj.SnapObj
+	complete := make(map[string]bool)
+	for _, o := range cur {
+		switch {
+		case o.Type != snapobj.Manual:
+		case o.Label == hp.label(false) && (pre == nil || o.Epoch.After(pre.Epoch)):
+			pre = o
+		case o.Label == hp.label(true):
+			complete[o.Meta[snapobj.MetaPair]] = true
+		}
+	}
+	if pre != nil && pre.Meta[snapobj.MetaPair] != "" && !complete[pre.Meta[snapobj.MetaPair]] {
+		c.Meta[snapobj.MetaPair] = pre.Meta[snapobj.MetaPair]
+	}
+	return &c
+}
+
+// prune returns the snapshots of the tool in cur which belong to the pairs beyond the keep newest ones, oldest first.
+// Pairs are deleted as a whole, they are ordered by their newest snapshot.
+func (hp *hookPair) prune(cur []*snapobj.SnapObj, keep int) []*snapobj.SnapObj {
+	pairs := make(map[string][]*snapobj.SnapObj)
+	newest := make(map[string]time.Time)
+	for _, o := range cur {
+		if o.Type != snapobj.Manual || (o.Label != hp.label(false) && o.Label != hp.label(true)) {
+			continue
+		}
+		id := o.Meta[snapobj.MetaPair]
+		if id == "" {
+			// Taken before pairs were recorded, the snapshot is a pair of its own.
+			id = o.FileName()
+		}
+		pairs[id] = append(pairs[id], o)
+		if o.Epoch.After(newest[id]) {
+			newest[id] = o.Epoch
+		}
+	}
+	if len(pairs) <= keep {
+		return nil
+	}
+
+	ids := make([]string, 0, len(pairs))
+	for id := range pairs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if !newest[ids[i]].Equal(newest[ids[j]]) {
+			return newest[ids[i]].After(newest[ids[j]])
+		}
+		return ids[i] > ids[j]
+	})
+	var del []*snapobj.SnapObj
+	for _, id := range ids[keep:] {
+		del = append(del, pairs[id]...)
+	}
+	sort.Slice(del, func(i, j int) bool { return del[i].Epoch.Before(del[j].Epoch) })
+	return del
+}
+
+// parentCommand returns the command line of the closest parent process running tool, e.g. 'apt install foo'.
+// It returns an empty string if there is no such process.
+func parentCommand(tool string) string {
+	pid := os.Getppid()
+	for i := 0; i < 10 && pid > 1; i++ {
+		cl, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil {
+			return ""
+		}
+		args := strings.Split(string(bytes.TrimRight(cl, "\x00")), "\x00")
+		// Tools written in scripting languages show up as arguments of their interpreter.
+		for j := 0; j < len(args) && j < 2; j++ {
+			if strings.HasPrefix(filepath.Base(args[j]), tool) {
+				args[j] = filepath.Base(args[j])
+				return strings.Join(args[j:], " ")
+			}
+		}
+		if pid, err = parentPid(pid); err != nil {
+			return ""
+		}
+	}
+	return ""
+}
+
+// parentPid returns the pid of the parent of process pid.
+func parentPid(pid int) (int, error) {
+	st, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name in parentheses may contain spaces, the parent pid is the second field after it.
+	i := bytes.LastIndexByte(st, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid stat of pid %d", pid)
+	}
+	f := strings.Fields(string(st[i+1:]))
+	if len(f) < 2 {
+		return 0, fmt.Errorf("invalid stat of pid %d", pid)
+	}
+	return strconv.Atoi(f[1])
+}
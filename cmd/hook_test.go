@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+// hookSnap returns a snapshot labeled label taken at minute min, belonging to the pair id if non-empty.
+func hookSnap(label string, min int, id string) *snapobj.SnapObj {
+	so := &snapobj.SnapObj{Type: snapobj.Manual, Label: label, Epoch: time.Unix(int64(min)*60, 0).UTC()}
+	if id != "" {
+		so.Meta = map[string]string{snapobj.MetaPair: id}
+	}
+	return so
+}
+
+func TestHookLink(t *testing.T) {
+	tests := []struct {
+		desc string
+		post bool
+		cur  []*snapobj.SnapObj
+		want string
+	}{
+		{
+			desc: "pre starts a pair",
+			cur:  []*snapobj.SnapObj{hookSnap("apt-pre", 1, "a")},
+			want: "new",
+		},
+		{
+			desc: "post joins newest pre",
+			post: true,
+			cur: []*snapobj.SnapObj{
+				hookSnap("apt-pre", 1, "a"),
+				hookSnap("apt-post", 2, "a"),
+				hookSnap("apt-pre", 3, "b"),
+				hookSnap("dnf-pre", 4, "c"),
+			},
+			want: "b",
+		},
+		{
+			desc: "post without pre",
+			post: true,
+			cur: []*snapobj.SnapObj{
+				hookSnap("apt-pre", 1, "a"),
+				hookSnap("apt-post", 2, "a"),
+			},
+			want: "new",
+		},
+		{
+			desc: "pre taken before pairs were recorded",
+			post: true,
+			cur:  []*snapobj.SnapObj{hookSnap("apt-pre", 1, "")},
+			want: "new",
+		},
+	}
+	for _, tt := range tests {
+		hp := &hookPair{tool: "apt", post: tt.post, id: "new"}
+		so := hookSnap(hp.label(tt.post), 10, "")
+		so.Meta = map[string]string{snapobj.MetaCommand: "apt upgrade"}
+		got := hp.link(so, tt.cur)
+		want := map[string]string{snapobj.MetaCommand: "apt upgrade", snapobj.MetaPair: tt.want}
+		if diff := cmp.Diff(want, got.Meta); diff != "" {
+			t.Errorf("%s: link() meta mismatch (-want +got)\n%s", tt.desc, diff)
+		}
+		if _, ok := so.Meta[snapobj.MetaPair]; ok {
+			t.Errorf("%s: link() modified its argument", tt.desc)
+		}
+	}
+}
+
+func TestHookPrune(t *testing.T) {
+	cur := []*snapobj.SnapObj{
+		hookSnap("apt-pre", 1, ""),
+		hookSnap("apt-post", 2, ""),
+		hookSnap("apt-pre", 3, "a"),
+		hookSnap("apt-post", 4, "a"),
+		hookSnap("apt-post", 5, "b"),
+		hookSnap("apt-pre", 6, "c"),
+		hookSnap("apt-post", 7, "c"),
+		hookSnap("dnf-pre", 0, "d"),
+		hookSnap("pre-upgrade", 0, ""),
+		{Type: snapobj.Daily, Epoch: time.Unix(0, 0).UTC()},
+	}
+	tests := []struct {
+		desc string
+		keep int
+		want []*snapobj.SnapObj
+	}{
+		{
+			desc: "keep all",
+			keep: 5,
+		},
+		{
+			desc: "unpaired snapshots",
+			keep: 3,
+			want: cur[:2],
+		},
+		{
+			desc: "whole pairs",
+			keep: 1,
+			want: cur[:5],
+		},
+	}
+	hp := &hookPair{tool: "apt"}
+	for _, tt := range tests {
+		got := hp.prune(cur, tt.keep)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: prune() mismatch (-want +got)\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestHookMetaLongCommand(t *testing.T) {
+	pkgs := strings.Repeat(" linux-headers-6.1.0-ä-amd64", 100)
+	tests := []struct {
+		desc    string
+		command string
+		want    string
+	}{
+		{"short", "apt install\tfoo", "apt install foo"},
+		{"exact", strings.Repeat("a", snapobj.MaxMetaLen), strings.Repeat("a", snapobj.MaxMetaLen)},
+		{"oversized", "apt install" + pkgs, ""},
+	}
+	for _, tt := range tests {
+		m := newMeta(tt.command)
+		for k, v := range m {
+			if err := snapobj.ValidMeta(v); err != nil {
+				t.Errorf("%s: newMeta() %s is invalid: %v", tt.desc, k, err)
+			}
+		}
+		got := m[snapobj.MetaCommand]
+		if tt.want != "" && got != tt.want {
+			t.Errorf("%s: newMeta() command = %q, want %q", tt.desc, got, tt.want)
+		}
+		if tt.want == "" && (!strings.HasSuffix(got, "...") || !strings.HasPrefix(tt.command, strings.TrimSuffix(got, "...")) || !utf8.ValidString(got)) {
+			t.Errorf("%s: newMeta() command = %q, want a valid prefix of the command followed by '...'", tt.desc, got)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/policy"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/adrian-bl/minisnap/lib/stream"
+)
+
+// listEntry describes a single snapshot in JSON mode.
+type listEntry struct {
+	Volume  string    `json:"volume"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+	Age     float64   `json:"age_seconds"`
+	Label   string    `json:"label,omitempty"`
+	// Expires is nil if the snapshot is deleted on the next run.
+	// Manual snapshots report their own expiry instead, which is nil if they are kept forever.
+	Expires *time.Time `json:"expires"`
+	Used    *int64     `json:"used_bytes,omitempty"`
+	// Meta holds the metadata stored with the snapshot, such as its creator.
+	Meta map[string]string `json:"meta,omitempty"`
+	// Source is the name of an adopted snapshot, as given by the tool which created it.
+	Source string `json:"source,omitempty"`
+}
+
+// listMain implements the 'list' command.
+func listMain(g *globals, args []string) {
+	fl := g.flagSet("list")
+	types := fl.String("type", "", "comma separated list of snapshot types to show, e.g. 'daily,weekly' or 'manual'")
+	fl.Parse(args)
+
+	conf := g.config()
+
+	filter := make(map[snapobj.Type]bool)
+	if *types != "" {
+		for _, t := range strings.Split(*types, ",") {
+			t = strings.TrimSpace(t)
+			if t == snapobj.Type(snapobj.Manual).String() {
+				filter[snapobj.Manual] = true
+				continue
+			}
+			st, err := snapobj.ToType(t)
+			if err != nil {
+				xfail("invalid type '%s': %v", t, err)
+			}
+			filter[st] = true
+		}
+	}
+
+	now := time.Now()
+	entries := make([]listEntry, 0)
+	var failed bool
+	// Without arguments, list all configured volumes.
+	for _, vol := range volumes(fl, fl.NArg() == 0, conf) {
+		le, err := list(vol, conf, filter, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "volume %s: %v\n", vol, err)
+			failed = true
+			continue
+		}
+		entries = append(entries, le...)
+	}
+
+	if g.json {
+		printJSON(entries)
+	} else {
+		printList(entries, now)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// list returns the snapshots of a single volume, oldest first.
+func list(vol string, conf VolPolicy, filter map[snapobj.Type]bool, now time.Time) ([]listEntry, error) {
+	vp, ok := conf[vol]
+	if !ok {
+		return nil, fmt.Errorf("not defined in config")
+	}
+
+	// Listing never changes anything: open the volume in dry run mode.
+	fss, err := fs.ForVolume(vol, vp.Options, &exec.Exec{DryRun: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open volume: %v", err)
+	}
+	cur, err := fss.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather current snapshots: %v", err)
+	}
+
+	var sizes map[string]int64
+	if sz, ok := fss.(fs.Sizer); ok {
+		if sizes, err = sz.Sizes(); err != nil {
+			return nil, fmt.Errorf("failed to query snapshot sizes: %v", err)
+		}
+	}
+
+	// Snapshots which are deleted by the next run have already expired.
+	p := policy.Policy{Now: now, Keep: vp.Schedule}
+	plan, err := p.Plan(cur)
+	if err != nil {
+		return nil, fmt.Errorf("could not construct a plan: %v", err)
+	}
+	expired := make(map[string]bool)
+	for _, o := range plan {
+		if o.Delete {
+			expired[o.Target.FileName()] = true
+		}
+	}
+
+	sort.Slice(cur, func(i, j int) bool { return cur[i].Epoch.Before(cur[j].Epoch) })
+	var le []listEntry
+	for _, s := range cur {
+		if len(filter) > 0 && !filter[s.Type] {
+			continue
+		}
+		e := listEntry{
+			Volume:  vol,
+			Name:    s.FileName(),
+			Type:    s.Type.String(),
+			Created: s.Epoch,
+			Age:     now.Sub(s.Epoch).Seconds(),
+			Label:   s.Label,
+			Meta:    s.Meta,
+			Source:  s.Source,
+		}
+		if s.Type == snapobj.Manual {
+			if !s.Expires.IsZero() {
+				exp := s.Expires
+				e.Expires = &exp
+			}
+		} else if !expired[e.Name] {
+			exp := p.Expiry(s)
+			e.Expires = &exp
+		}
+		if n, ok := sizes[e.Name]; ok {
+			e.Used = &n
+		}
+		le = append(le, e)
+	}
+	return le, nil
+}
+
+// printList prints entries as a table.
+func printList(entries []listEntry, now time.Time) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "VOLUME\tTYPE\tLABEL\tCREATED\tAGE\tEXPIRES\tUSED\tNOTE\n")
+	for _, e := range entries {
+		exp := "next run"
+		switch {
+		case e.Label != "" && e.Expires == nil:
+			exp = "never"
+		case e.Label != "" && !e.Expires.After(now):
+			// Expired manual snapshots are deleted by the next run.
+		case e.Expires != nil:
+			exp = e.Expires.Local().Format("2006-01-02 15:04")
+		}
+		label := e.Label
+		if label == "" {
+			label = "-"
+		}
+		used := "-"
+		if e.Used != nil {
+			used = stream.FormatSize(*e.Used)
+		}
+		note := e.Meta[snapobj.MetaNote]
+		if note == "" {
+			note = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Volume, e.Type, label, e.Created.Local().Format("2006-01-02 15:04"),
+			formatAge(now.Sub(e.Created)), exp, used, note)
+	}
+	tw.Flush()
+}
+
+// formatAge returns a short human readable version of d, e.g. '3d4h'.
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/lock"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// version is the version of msnap, set at build time using -ldflags '-X main.version=...'.
+var version = "devel"
+
+// newMeta returns the metadata stored with snapshots created by this process on behalf of command.
+func newMeta(command string) map[string]string {
+	m := map[string]string{
+		snapobj.MetaVersion: version,
+		snapobj.MetaCommand: metaValue(command),
+	}
+	if h, err := os.Hostname(); err == nil {
+		m[snapobj.MetaHostname] = h
+	}
+	// Runs from sudo are attributed to the invoking user.
+	if u := os.Getenv("SUDO_USER"); u != "" {
+		m[snapobj.MetaCreator] = u
+	} else if u, err := user.Current(); err == nil {
+		m[snapobj.MetaCreator] = u.Username
+	}
+	return m
+}
+
+// commandLine returns the command line of this process.
+func commandLine() string {
+	return strings.Join(os.Args, " ")
+}
+
+// metaValue returns v with the characters not accepted by snapobj.ValidMeta replaced by spaces, and
+// shortened to snapobj.MaxMetaLen, e.g. for package manager commands installing many packages.
+func metaValue(v string) string {
+	v = strings.NewReplacer("\t", " ", "\n", " ").Replace(v)
+	if len(v) <= snapobj.MaxMetaLen {
+		return v
+	}
+	const ellipsis = "..."
+	n := snapobj.MaxMetaLen - len(ellipsis)
+	// Do not cut a multi-byte character in half.
+	for n > 0 && !utf8.RuneStart(v[n]) {
+		n--
+	}
+	return v[:n] + ellipsis
+}
+
+// annotateMain implements the 'annotate' command.
+func annotateMain(g *globals, args []string) {
+	fl := g.flagSet("annotate")
+	note := fl.String("note", "", "free-text note stored with the snapshot, an empty note removes it")
+	fl.Parse(args)
+
+	if fl.NArg() != 2 {
+		fl.Usage()
+		xfail("\nWant a volume and a snapshot")
+	}
+	var changed bool
+	fl.Visit(func(f *flag.Flag) { changed = changed || f.Name == "note" })
+	if !changed {
+		xfail("nothing to change, use -note")
+	}
+	if err := snapobj.ValidMeta(*note); err != nil {
+		xfail("invalid -note: %v", err)
+	}
+
+	conf := g.config()
+	vol := filepath.Clean(fl.Arg(0))
+	if err := lockedAnnotate(g.locker(), vol, conf, fl.Arg(1), *note, g.executor()); err != nil {
+		xfail("volume %s: %v", vol, err)
+	}
+}
+
+// lockedAnnotate stores note with the snapshot name of vol, while holding the locks of vol if lk is non-nil.
+// Runs may otherwise delete or rename the snapshot, or replace the metadata file of btrfs snapshots meanwhile.
+func lockedAnnotate(lk *lock.Locker, vol string, conf VolPolicy, name, note string, e *exec.Exec) error {
+	vp, ok := conf[vol]
+	if !ok {
+		return fmt.Errorf("not defined in config")
+	}
+	if lk != nil {
+		unlock, err := lockVolume(lk, vol, conf)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	fss, err := fs.ForVolume(vol, vp.Options, e)
+	if err != nil {
+		return fmt.Errorf("failed to open volume: %v", err)
+	}
+	a, ok := fss.(fs.Annotator)
+	if !ok {
+		return fmt.Errorf("%s does not support metadata", fss.Description())
+	}
+	cur, err := fss.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather current snapshots: %v", err)
+	}
+	so, err := findSnapshot(cur, name)
+	if err != nil {
+		return err
+	}
+	if err := a.Annotate(so, map[string]string{snapobj.MetaNote: note}); err != nil {
+		return fmt.Errorf("failed to store metadata of %s: %v", so.FileName(), err)
+	}
+	return nil
+}
+
+// findSnapshot returns the snapshot of cur with the given name, as printed by 'list -json', or the newest
+// snapshot if name is 'latest'.
+func findSnapshot(cur []*snapobj.SnapObj, name string) (*snapobj.SnapObj, error) {
+	var found *snapobj.SnapObj
+	for _, so := range cur {
+		switch {
+		case name == "latest" && (found == nil || so.Epoch.After(found.Epoch)):
+			found = so
+		case so.FileName() == name:
+			return so, nil
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no snapshot '%s'", name)
+	}
+	return found, nil
+}
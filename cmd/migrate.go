@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/lock"
+)
+
+// migrateMain implements the 'migrate' command.
+func migrateMain(g *globals, args []string) {
+	fl := g.flagSet("migrate")
+	all := allFlag(fl)
+	fl.Parse(args)
+
+	conf := g.config()
+	vols := volumes(fl, *all, conf)
+	lk := g.locker()
+
+	results := make([]*result, len(vols))
+	for i, vol := range vols {
+		r := &result{vol: vol}
+		results[i] = r
+		e := g.executor()
+		if r.err = lockedMigrate(lk, vol, conf, e); r.err != nil {
+			e.Eprintf("volume %s: %v\n", vol, r.err)
+		}
+	}
+	os.Exit(exitCode(results))
+}
+
+// lockedMigrate renames the adopted snapshots of vol into its naming, while holding the locks of vol if lk
+// is non-nil.
+func lockedMigrate(lk *lock.Locker, vol string, conf VolPolicy, e *exec.Exec) error {
+	vp, ok := conf[vol]
+	if !ok {
+		return fmt.Errorf("not defined in config")
+	}
+	if len(vp.Options.Adopt) == 0 && vp.Options.Naming == "" {
+		return fmt.Errorf("nothing to migrate, set 'adopt' or 'naming'")
+	}
+	if lk != nil {
+		unlock, err := lockVolume(lk, vol, conf)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	fss, err := fs.ForVolume(vol, vp.Options, e)
+	if err != nil {
+		return fmt.Errorf("failed to open volume: %v", err)
+	}
+	rn, ok := fss.(fs.Renamer)
+	if !ok {
+		return fmt.Errorf("%s does not support renaming snapshots", fss.Description())
+	}
+	cur, err := fss.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather current snapshots: %v", err)
+	}
+
+	have := make(map[string]bool)
+	for _, so := range cur {
+		if !so.Adopted() {
+			have[so.FileName()] = true
+		}
+	}
+	var n int
+	for _, so := range cur {
+		if !so.Adopted() {
+			continue
+		}
+		// Snapshots of the same type and time map to the same name, e.g. if two adopted tools
+		// took them at once.
+		if have[so.FileName()] {
+			return fmt.Errorf("can not rename %s, %s already exists", so.Source, so.FileName())
+		}
+		e.Printf("Renaming %s to %s on %s\n", so.Source, so.FileName(), fss.Description())
+		if err := rn.Rename(so); err != nil {
+			return fmt.Errorf("failed to rename %s: %v", so.Source, err)
+		}
+		have[so.FileName()] = true
+		n++
+	}
+	e.Printf("Migrated %d snapshots on %s\n", n, fss.Description())
+	return nil
+}
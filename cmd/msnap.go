@@ -1,75 +1,450 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/adrian-bl/minisnap/lib/archive"
 	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/lock"
 	"github.com/adrian-bl/minisnap/lib/opts"
 	"github.com/adrian-bl/minisnap/lib/policy"
+	"github.com/adrian-bl/minisnap/lib/replicate"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
 )
 
+// globals holds the flags shared by all commands.
+type globals struct {
+	confFile    string
+	dryRun      bool
+	verbose     bool
+	json        bool
+	lockDir     string
+	lockTimeout time.Duration
+}
+
+// register adds the global flags to fl, defaulting to the current values of g.
+// Global flags can therefore be passed before or after the command name.
+func (g *globals) register(fl *flag.FlagSet) {
+	fl.StringVar(&g.confFile, "config", g.confFile, "path to configuration file")
+	fl.BoolVar(&g.dryRun, "dry_run", g.dryRun, "do not execute, just print what would be done")
+	fl.BoolVar(&g.verbose, "verbose", g.verbose, "print executed commands and transfer progress")
+	fl.BoolVar(&g.json, "json", g.json, "print machine readable JSON output")
+	fl.StringVar(&g.lockDir, "lock_dir", g.lockDir, "directory holding the lock files")
+	fl.DurationVar(&g.lockTimeout, "lock_timeout", g.lockTimeout, "time to wait for locks held by other runs, negative values wait forever")
+}
+
+// locker returns the locker to use, or nil in dry run mode as nothing gets changed.
+func (g *globals) locker() *lock.Locker {
+	if g.dryRun {
+		return nil
+	}
+	return &lock.Locker{Dir: g.lockDir, Timeout: g.lockTimeout}
+}
+
+// executor returns the executor of commands changing snapshots. In JSON mode, its messages are printed
+// to stderr, so stdout only holds JSON.
+func (g *globals) executor() *exec.Exec {
+	e := &exec.Exec{DryRun: g.dryRun, Verbose: g.verbose}
+	if g.json {
+		e.Stdout = os.Stderr
+	}
+	return e
+}
+
+// flagSet returns a flag set for the named command, including the global flags.
+func (g *globals) flagSet(name string) *flag.FlagSet {
+	c := commands[name]
+	fl := flag.NewFlagSet(name, flag.ExitOnError)
+	fl.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [OPTION] %s\n\n", os.Args[0], name, c.args)
+		fmt.Fprintf(os.Stderr, "%s\n\n", c.help)
+		fl.PrintDefaults()
+	}
+	g.register(fl)
+	return fl
+}
+
+// flagGiven reports whether the global or command flag name was set on the command line, before or after
+// the command name of fl.
+func flagGiven(fl *flag.FlagSet, name string) bool {
+	given := false
+	visit := func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	}
+	flag.CommandLine.Visit(visit)
+	fl.Visit(visit)
+	return given
+}
+
+// config parses the configuration file or exits.
+func (g *globals) config() VolPolicy {
+	conf, err := parseConfig(g.confFile)
+	if err != nil {
+		xfail("failed to parse config: %v", err)
+	}
+	return conf
+}
+
+// command describes a msnap subcommand.
+type command struct {
+	// args is a synopsis of the non-flag arguments.
+	args string
+	help string
+	main func(g *globals, args []string)
+}
+
+var commands map[string]command
+
 func init() {
+	// Initialized here as some commands refer back to the table for their usage.
+	commands = map[string]command{
+		"run": {"vol [vol...]", "Creates due snapshots, replicates and archives them, then deletes expired snapshots.",
+			func(g *globals, args []string) { runMain(g, "run", phaseAll, args) }},
+		"create": {"vol [vol...]", "Creates due snapshots without deleting expired ones.",
+			func(g *globals, args []string) { runMain(g, "create", phaseCreate, args) }},
+		"prune": {"vol [vol...]", "Deletes expired snapshots without creating due ones.",
+			func(g *globals, args []string) { runMain(g, "prune", phaseDelete, args) }},
+		"daemon": {"[vol...]", "Keeps running and processes the given volumes, or all configured volumes, whenever snapshots are due.",
+			daemonMain},
+		"snap": {"-label label vol [vol...]", "Creates a labeled snapshot outside of the schedule, deleted once it expires.",
+			snapMain},
+		"hook": {"pre|post -tool tool [vol...]", "Creates a labeled snapshot from a package manager hook, keeping the configured number of them.",
+			hookMain},
+		"plan":          {"vol [vol...]", "Prints the snapshots which would be created and deleted.", planMain},
+		"list":          {"[vol...]", "Lists the snapshots of the given volumes, or of all configured volumes.", listMain},
+		"status":        {"vol [vol...]", "Prints the replication state of the given volumes.", statusMain},
+		"systemd-units": {"-output dir", "Writes a systemd service and timer for each configured volume.", systemdMain},
+		"check-config":  {"", "Validates the configuration file and checks each target.", checkConfigMain},
+		"show-config": {"[vol...]", "Prints the configuration of the given volumes, or of all volumes, with defaults and profiles applied.",
+			showConfigMain},
+		"annotate": {"-note text vol snapshot", "Stores a note with a snapshot, given by its name or as 'latest'.", annotateMain},
+		"migrate":  {"vol [vol...]", "Renames adopted snapshots into the naming of their volume.", migrateMain},
+		"archive":  {"restore dest", "Replays the archived streams leading to a snapshot into a fresh dataset or directory.", archiveMain},
+	}
+
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION] vol [vol...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION] [command] [OPTION] [args...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Fprintf(os.Stderr, "  %-14s %s\n", n, commands[n].help)
+		}
+		fmt.Fprintf(os.Stderr, "\nWithout a command, the arguments are passed to 'run'.\n")
+		fmt.Fprintf(os.Stderr, "Use '%s help command' for the options of a command.\n\nGlobal options:\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 }
 
-var (
-	dryRun   = flag.Bool("dry_run", false, "do not execute, just print what would be done")
-	verbose  = flag.Bool("verbose", false, "print executed commands")
-	confFile = flag.String("config", "/etc/minisnap.conf", "path to configuration file")
-)
-
 func main() {
-	flag.Parse()
+	g := &globals{confFile: "/etc/minisnap.conf", lockDir: lock.DefaultDir}
+	g.register(flag.CommandLine)
 
-	vols := flag.Args()
-	if len(vols) == 0 {
+	// Unknown flags are left to the implicit 'run' command, so parse quietly.
+	cl := flag.CommandLine
+	usage := cl.Usage
+	cl.Init(os.Args[0], flag.ContinueOnError)
+	cl.SetOutput(ioutil.Discard)
+	cl.Usage = func() {}
+	err := cl.Parse(os.Args[1:])
+	cl.SetOutput(nil)
+	cl.Usage = usage
+	if err == flag.ErrHelp {
 		flag.Usage()
-		xfail("\nNo volumes given, exiting")
+		return
 	}
 
-	conf, err := parseConfig(*confFile)
+	args := flag.Args()
+	name := "run"
 	if err != nil {
-		xfail("failed to parse '%s': %v", *confFile, err)
+		// Options of the implicit 'run' command, e.g. 'msnap -all'.
+		args = os.Args[1:]
+	} else if len(args) > 0 {
+		if args[0] == "help" {
+			if len(args) < 2 {
+				flag.Usage()
+				return
+			}
+			c, ok := commands[args[1]]
+			if !ok {
+				xfail("unknown command '%s'", args[1])
+			}
+			c.main(g, []string{"-help"})
+			return
+		}
+		if _, ok := commands[args[0]]; ok {
+			name, args = args[0], args[1:]
+		}
 	}
+	commands[name].main(g, args)
+}
+
+// phase selects the parts of a run which are executed.
+type phase int
+
+const (
+	phaseCreate phase = 1 << iota
+	phaseExport
+	phaseDelete
+	phaseAll = phaseCreate | phaseExport | phaseDelete
+)
+
+// allFlag registers the -all flag with fl.
+func allFlag(fl *flag.FlagSet) *bool {
+	return fl.Bool("all", false, "process all configured volumes, skipping those which are not mounted")
+}
 
-	for _, vol := range vols {
-		vol = filepath.Clean(vol)
-		vp, ok := conf[vol]
-		if !ok {
-			xfail(fmt.Sprintf("volume %s: not defined in config", vol))
+// volumes returns the volumes given on the command line of fl, or all configured volumes if all is set.
+// Configured volumes which are not mounted, such as removable disks, are skipped with a warning.
+func volumes(fl *flag.FlagSet, all bool, conf VolPolicy) []string {
+	if !all {
+		if fl.NArg() == 0 {
+			fl.Usage()
+			xfail("\nNo volumes given, exiting")
+		}
+		vols := make([]string, fl.NArg())
+		for i, vol := range fl.Args() {
+			vols[i] = filepath.Clean(vol)
 		}
-		p := &policy.Policy{
-			Now:  time.Now(),
-			Keep: vp.Schedule,
+		return vols
+	}
+	if fl.NArg() > 0 {
+		fl.Usage()
+		xfail("\nVolumes can not be combined with -all")
+	}
+
+	names := make([]string, 0, len(conf))
+	for vol := range conf {
+		names = append(names, vol)
+	}
+	sort.Strings(names)
+
+	var vols []string
+	for _, vol := range names {
+		mounted, err := fs.Mounted(vol)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping volume %s: %v\n", vol, err)
+			continue
 		}
-		if err := snapshot(vol, vp.Options, p, *dryRun, *verbose); err != nil {
-			xfail(fmt.Sprintf("volume %s: %v", vol, err))
+		if !mounted {
+			fmt.Fprintf(os.Stderr, "Warning: skipping volume %s: not mounted\n", vol)
+			continue
 		}
+		vols = append(vols, vol)
 	}
+	return vols
+}
+
+// modeFlags registers the -create_only and -prune_only flags with fl.
+// The returned function narrows ph down to the selected mode once fl was parsed.
+func modeFlags(fl *flag.FlagSet) func(ph phase) phase {
+	createOnly := fl.Bool("create_only", false, "only create due snapshots, do not delete expired ones")
+	pruneOnly := fl.Bool("prune_only", false, "only delete expired snapshots, do not create due ones")
+	return func(ph phase) phase {
+		switch {
+		case *createOnly && *pruneOnly:
+			xfail("-create_only and -prune_only are mutually exclusive")
+		case *createOnly:
+			return ph & phaseCreate
+		case *pruneOnly:
+			return ph & phaseDelete
+		}
+		return ph
+	}
+}
+
+// planPhases returns the plan for the phases in ph.
+// Without the create phase, deletions must not count on due snapshots replacing them.
+func planPhases(p *policy.Policy, cur []*snapobj.SnapObj, ph phase) ([]*policy.Plan, error) {
+	if ph&phaseCreate == 0 {
+		if ph&phaseDelete == 0 {
+			return []*policy.Plan{}, nil
+		}
+		return p.Prune(cur)
+	}
+	pl, err := p.Plan(cur)
+	if err != nil || ph&phaseDelete != 0 {
+		return pl, err
+	}
+	return policy.Creations(pl), nil
+}
+
+// runMain implements the 'run', 'create' and 'prune' commands.
+func runMain(g *globals, name string, ph phase, args []string) {
+	fl := g.flagSet(name)
+	all := allFlag(fl)
+	parallel := fl.Int("parallel", 1, "number of volumes to process concurrently")
+	serialize := fl.Bool("serialize_pools", false, "with -parallel, process volumes on the same pool one after another")
+	if ph == phaseAll {
+		mode := modeFlags(fl)
+		fl.Parse(args)
+		ph = mode(ph)
+	} else {
+		fl.Parse(args)
+	}
+
+	conf := g.config()
+	if *parallel < 1 {
+		xfail("-parallel must be at least 1")
+	}
+
+	rn := &runner{g: g, ph: ph, parallel: *parallel, serialize: *serialize}
+	results := rn.run(conf, volumes(fl, *all, conf))
+	printSummary(results, g.json)
+	os.Exit(exitCode(results))
+}
 
+// runner processes volumes for the run commands and the daemon.
+type runner struct {
+	g         *globals
+	ph        phase
+	parallel  int
+	serialize bool
+	// stop is closed to shut down once the current volumes finished their create phase.
+	stop <-chan struct{}
 }
 
-// snapshot performs the snapshotting operation on the given volume.
-func snapshot(vol string, vopts opts.VolOptions, p *policy.Policy, dryRun, verbose bool) error {
-	fss, err := fs.ForVolume(vol, vopts, dryRun, verbose)
+// run processes vols and returns their results.
+func (rn *runner) run(conf VolPolicy, vols []string) []*result {
+	lk := rn.g.locker()
+	results := make([]*result, len(vols))
+	var mu sync.Mutex
+	runGroups(groupVolumes(vols, conf, rn.serialize), rn.parallel, func(i int) {
+		vol := vols[i]
+		r := &result{vol: vol}
+		results[i] = r
+
+		e := rn.g.executor()
+		stdout, stderr := &lockedBuffer{}, &lockedBuffer{}
+		var js io.Writer
+		if rn.g.json {
+			js = os.Stdout
+		}
+		if rn.parallel > 1 {
+			// Keep the output of concurrent volumes apart, including their JSON events.
+			e.Stdout, e.Stderr = stdout, stderr
+			if rn.g.json {
+				e.Stdout, js = stderr, stdout
+			}
+		}
+
+		switch {
+		case conf[vol] == nil:
+			r.err = fmt.Errorf("not defined in config")
+		case stopped(rn.stop):
+			r.err = errStopped
+		default:
+			r.err = lockedSnapshot(lk, vol, conf, rn.ph, r, e, js, rn.stop)
+		}
+		if r.err != nil {
+			e.Eprintf("volume %s: %v\n", vol, r.err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		stdout.WriteTo(os.Stdout)
+		stderr.WriteTo(os.Stderr)
+	})
+	return results
+}
+
+// errStopped is returned for volumes which were not finished due to a shutdown.
+var errStopped = fmt.Errorf("stopped by shutdown")
+
+// stopped returns true if stop was closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// lockVolume acquires the lock of vol. Recursive volumes also change the snapshots of the configured
+// volumes beneath them, so their locks are acquired as well, in sorted order to avoid deadlocks.
+// The returned function releases all of them.
+func lockVolume(lk *lock.Locker, vol string, conf VolPolicy) (func(), error) {
+	names := []string{vol}
+	if vp, ok := conf[vol]; ok && vp.Options.Recursive {
+		prefix := strings.TrimSuffix(vol, "/") + "/"
+		for v := range conf {
+			if strings.HasPrefix(v, prefix) {
+				names = append(names, v)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	var held []*lock.Lock
+	unlock := func() {
+		for _, l := range held {
+			l.Unlock()
+		}
+	}
+	for _, n := range names {
+		l, err := lk.Lock(n)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return unlock, nil
+}
+
+// lockedSnapshot calls snapshot while holding the locks of vol, if lk is non-nil.
+func lockedSnapshot(lk *lock.Locker, vol string, conf VolPolicy, ph phase, r *result, e *exec.Exec, js io.Writer, stop <-chan struct{}) error {
+	if lk != nil {
+		unlock, err := lockVolume(lk, vol, conf)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	vp := conf[vol]
+
+	// The plan must be based on the state found after acquiring the lock.
+	p := &policy.Policy{
+		Now:  time.Now(),
+		Keep: vp.Schedule,
+	}
+	return snapshot(vol, vp.Options, p, ph, r, e, js, stop)
+}
+
+// snapshot performs the phases of the snapshotting operation selected by ph on the given volume.
+// Created and deleted snapshots as well as failures are counted in r. Once stop is closed, the phases
+// following the create phase are skipped.
+func snapshot(vol string, vopts opts.VolOptions, p *policy.Policy, ph phase, r *result, e *exec.Exec, js io.Writer, stop <-chan struct{}) error {
+	fss, err := fs.ForVolume(vol, vopts, e)
 	if err != nil {
 		return fmt.Errorf("failed to open volume: %v", err)
 	}
 
-	fmt.Printf("Working on %s\n", fss.Description())
+	e.Printf("Working on %s\n", fss.Description())
+	meta := newMeta(commandLine())
 	cur, err := fss.Gather()
 	if err != nil {
 		return fmt.Errorf("failed to gather current snapshots: %v", err)
 	}
 
-	plan, err := p.Plan(cur)
+	plan, err := planPhases(p, cur, ph)
 	if err != nil {
 		return fmt.Errorf("could not construct a plan: %v", err)
 	}
@@ -77,32 +452,146 @@ func snapshot(vol string, vopts opts.VolOptions, p *policy.Policy, dryRun, verbo
 	var failed bool
 	for _, o := range plan {
 		if !o.Delete {
+			o.Target.Meta = meta
 			if err := fss.Create(o.Target); err != nil {
-				fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", o.Target, err)
+				e.Eprintf("Error creating %s: %v\n", o.Target, err)
+				r.failed.Snapshot++
 				failed = true
+				continue
 			}
+			r.created++
 		}
 	}
 	if failed {
 		return fmt.Errorf("errors during create phase, refusing to enter delete phase")
 	}
+	if stopped(stop) {
+		return errStopped
+	}
 
+	// Export before deleting anything, so the base of the next incremental stream is still around.
+	var eerr []string
+	if vopts.Replicate != nil && ph&phaseExport != 0 {
+		if err := replicateVolume(vol, fss, vopts.Replicate, e, js); err != nil {
+			eerr = append(eerr, fmt.Sprintf("replication failed: %v", err))
+			r.failed.Replication++
+		}
+	}
+	if vopts.Archive != nil && ph&phaseExport != 0 {
+		if err := archiveVolume(fss, vopts.Archive, p, e); err != nil {
+			eerr = append(eerr, fmt.Sprintf("archiving failed: %v", err))
+			r.failed.Archive++
+		}
+	}
+
+	if stopped(stop) {
+		return errStopped
+	}
 	for _, o := range plan {
 		if o.Delete {
 			if err := fss.Delete(o.Target); err != nil {
-				fmt.Fprintf(os.Stderr, "Error deleting %s: %v\n", o.Target, err)
+				e.Eprintf("Error deleting %s: %v\n", o.Target, err)
+				r.failed.Delete++
 				failed = true
+				continue
 			}
+			r.deleted++
 		}
 	}
 	if failed {
 		return fmt.Errorf("delete phase had errors")
 	}
+	if len(eerr) > 0 {
+		return fmt.Errorf("%s", strings.Join(eerr, ", "))
+	}
 
 	return nil
 }
 
+// replicateVolume sends all new snapshots of fss to the configured replication target.
+// In JSON mode, progress events are written to js, which is nil otherwise.
+func replicateVolume(vol string, fss fs.FsSnap, ro *opts.Replicate, e *exec.Exec, js io.Writer) error {
+	snd, ok := fss.(fs.Sender)
+	if !ok {
+		return fmt.Errorf("%s does not support replication", fss.Description())
+	}
+	r, err := replicate.New(snd, ro, e)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case js != nil:
+		r.SetReporter(func(p replicate.Progress) {
+			writeJSON(js, jsonProgress{
+				Event:    "progress",
+				Volume:   vol,
+				Target:   p.Target,
+				Snapshot: p.Snapshot,
+				Bytes:    p.Bytes,
+				Total:    p.Total,
+				Rate:     int64(p.Rate()),
+				Elapsed:  p.Elapsed.Seconds(),
+				ETA:      p.ETA().Seconds(),
+				Done:     p.Done,
+			})
+		})
+	case e.Verbose:
+		r.SetReporter(func(p replicate.Progress) {
+			if !p.Done {
+				e.Printf("  %s: %s\n", p.Snapshot, p.Stats)
+			}
+		})
+	}
+	return r.Run()
+}
+
+// jsonProgress is printed for transfer progress reports in JSON mode.
+type jsonProgress struct {
+	Event    string  `json:"event"`
+	Volume   string  `json:"volume"`
+	Target   string  `json:"target"`
+	Snapshot string  `json:"snapshot"`
+	Bytes    int64   `json:"bytes"`
+	Total    int64   `json:"total_estimate,omitempty"`
+	Rate     int64   `json:"rate"`
+	Elapsed  float64 `json:"elapsed_seconds"`
+	ETA      float64 `json:"eta_seconds,omitempty"`
+	Done     bool    `json:"done"`
+}
+
+// printJSON prints v as a single line of JSON.
+func printJSON(v interface{}) {
+	writeJSON(os.Stdout, v)
+}
+
+// writeJSON writes v to w as a single line of JSON.
+func writeJSON(w io.Writer, v interface{}) {
+	pl, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(w, "%s\n", pl)
+}
+
+// archiveVolume writes the most recent snapshot of fss into the configured archive.
+func archiveVolume(fss fs.FsSnap, ao *opts.Archive, p *policy.Policy, e *exec.Exec) error {
+	snd, ok := fss.(fs.Sender)
+	if !ok {
+		return fmt.Errorf("%s does not support send streams", fss.Description())
+	}
+	store, err := archive.Open(ao, e)
+	if err != nil {
+		return err
+	}
+	a, err := archive.New(snd, store, ao, e)
+	if err != nil {
+		return err
+	}
+	return a.Run(p)
+}
+
 func xfail(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
-	os.Exit(1)
+	os.Exit(exitFailure)
 }
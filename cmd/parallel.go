@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+)
+
+// groupVolumes splits vols into groups of indices into vols. The volumes of a group are processed one
+// after another, separate groups may be processed concurrently. If serialize is set, volumes on the
+// same pool share a group.
+func groupVolumes(vols []string, conf VolPolicy, serialize bool) [][]int {
+	var groups [][]int
+	pools := make(map[string]int)
+	for i, vol := range vols {
+		if serialize {
+			if pool := volumePool(vol, conf); pool != "" {
+				if g, ok := pools[pool]; ok {
+					groups[g] = append(groups[g], i)
+					continue
+				}
+				pools[pool] = len(groups)
+			}
+		}
+		groups = append(groups, []int{i})
+	}
+	return groups
+}
+
+// volumePool returns the pool holding vol, or an empty string if unknown.
+func volumePool(vol string, conf VolPolicy) string {
+	vp, ok := conf[vol]
+	if !ok {
+		return ""
+	}
+	fss, err := fs.ForVolume(vol, vp.Options, &exec.Exec{DryRun: true})
+	if err != nil {
+		return ""
+	}
+	if p, ok := fss.(fs.Pooler); ok {
+		return p.Pool()
+	}
+	return ""
+}
+
+// runGroups calls fn for the indices of all groups, processing up to n groups concurrently.
+func runGroups(groups [][]int, n int, fn func(i int)) {
+	c := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range c {
+				for _, i := range g {
+					fn(i)
+				}
+			}
+		}()
+	}
+	for _, g := range groups {
+		c <- g
+	}
+	close(c)
+	wg.Wait()
+}
+
+// lockedBuffer is a buffer which can be written to concurrently, e.g. by all commands of a pipeline.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+// WriteTo writes the buffered data to w.
+func (l *lockedBuffer) WriteTo(w io.Writer) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.WriteTo(w)
+}
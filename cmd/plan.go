@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/policy"
+)
+
+// planMain implements the 'plan' command.
+func planMain(g *globals, args []string) {
+	fl := g.flagSet("plan")
+	all := allFlag(fl)
+	mode := modeFlags(fl)
+	fl.Parse(args)
+	ph := mode(phaseAll)
+
+	conf := g.config()
+	var failed bool
+	for _, vol := range volumes(fl, *all, conf) {
+		if err := plan(vol, conf, ph); err != nil {
+			fmt.Fprintf(os.Stderr, "volume %s: %v\n", vol, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// plan prints the operations the next run of phases ph would perform on a single volume.
+func plan(vol string, conf VolPolicy, ph phase) error {
+	vp, ok := conf[vol]
+	if !ok {
+		return fmt.Errorf("not defined in config")
+	}
+
+	// Planning never changes anything: open the volume in dry run mode.
+	fss, err := fs.ForVolume(vol, vp.Options, &exec.Exec{DryRun: true})
+	if err != nil {
+		return fmt.Errorf("failed to open volume: %v", err)
+	}
+	cur, err := fss.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather current snapshots: %v", err)
+	}
+	p := &policy.Policy{Now: time.Now(), Keep: vp.Schedule}
+	pl, err := planPhases(p, cur, ph)
+	if err != nil {
+		return fmt.Errorf("could not construct a plan: %v", err)
+	}
+
+	sort.Slice(pl, func(i, j int) bool {
+		if pl[i].Delete != pl[j].Delete {
+			return !pl[i].Delete
+		}
+		return pl[i].Target.Epoch.Before(pl[j].Target.Epoch)
+	})
+
+	fmt.Printf("%s:\n", fss.Description())
+	if len(pl) == 0 {
+		fmt.Printf("  nothing to do\n")
+	}
+	for _, o := range pl {
+		op := "create"
+		if o.Delete {
+			op = "delete"
+		}
+		fmt.Printf("  %s %s\n", op, o.Target.FileName())
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/lock"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// snapMain implements the 'snap' command.
+func snapMain(g *globals, args []string) {
+	fl := g.flagSet("snap")
+	label := fl.String("label", "", "label of the snapshot, e.g. 'pre-upgrade'")
+	expire := fl.String("expire", "", "age at which the snapshot is deleted, e.g. '14d' or '12h', kept forever if empty")
+	note := fl.String("note", "", "free-text note stored with the snapshot")
+	fl.Parse(args)
+
+	conf := g.config()
+	var ttl time.Duration
+	if *expire != "" {
+		var err error
+		if ttl, err = parseAge(*expire); err != nil || ttl <= 0 {
+			xfail("invalid -expire '%s', want a positive age such as '14d'", *expire)
+		}
+	}
+	so, err := snapobj.NewManual(*label, time.Now(), ttl)
+	if err != nil {
+		xfail("invalid -label: %v", err)
+	}
+	so.Meta = newMeta(commandLine())
+	if *note != "" {
+		if err := snapobj.ValidMeta(*note); err != nil {
+			xfail("invalid -note: %v", err)
+		}
+		so.Meta[snapobj.MetaNote] = *note
+	}
+
+	results := createManual(g, conf, volumes(fl, false, conf), so, nil)
+	printSummary(results, g.json)
+	os.Exit(exitCode(results))
+}
+
+// createManual creates the manual snapshot so on each of vols, taking the same locks as a run.
+// Snapshots which would be named like an existing one are not created.
+// If hp is non-nil, so is taken by a hook: it is linked to the other snapshot of its pair, and the oldest pairs
+// beyond the 'keep' of the hooks of each volume are deleted.
+func createManual(g *globals, conf VolPolicy, vols []string, so *snapobj.SnapObj, hp *hookPair) []*result {
+	lk := g.locker()
+	results := make([]*result, len(vols))
+	for i, vol := range vols {
+		r := &result{vol: vol}
+		results[i] = r
+		e := g.executor()
+		if r.err = lockedCreate(lk, vol, conf, so, hp, r, e); r.err != nil {
+			e.Eprintf("volume %s: %v\n", vol, r.err)
+		}
+	}
+	return results
+}
+
+// lockedCreate creates so on vol as described by createManual, while holding the locks of vol if lk is non-nil.
+func lockedCreate(lk *lock.Locker, vol string, conf VolPolicy, so *snapobj.SnapObj, hp *hookPair, r *result, e *exec.Exec) error {
+	vp, ok := conf[vol]
+	if !ok {
+		return fmt.Errorf("not defined in config")
+	}
+	if lk != nil {
+		unlock, err := lockVolume(lk, vol, conf)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	fss, err := fs.ForVolume(vol, vp.Options, e)
+	if err != nil {
+		return fmt.Errorf("failed to open volume: %v", err)
+	}
+	cur, err := fss.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather current snapshots: %v", err)
+	}
+	if hp != nil {
+		so = hp.link(so, cur)
+	}
+	var tmpl *snapobj.Template
+	if n, ok := fss.(fs.Namer); ok {
+		tmpl = n.Naming()
+	}
+	if nameTaken(tmpl, so, cur) {
+		res := time.Second
+		if tmpl != nil {
+			res = tmpl.Resolution()
+		}
+		r.failed.Snapshot++
+		return fmt.Errorf("snapshot %s exists already, manual snapshots with the same label must be taken at least %v apart",
+			tmpl.Format(so), res)
+	}
+	e.Printf("Creating %s on %s\n", so.FileName(), fss.Description())
+	if err := fss.Create(so); err != nil {
+		r.failed.Snapshot++
+		return fmt.Errorf("failed to create %s: %v", so.FileName(), err)
+	}
+	r.created++
+
+	if hp == nil || vp.Options.Hooks == nil || vp.Options.Hooks.Keep < 1 {
+		return nil
+	}
+	for _, o := range hp.prune(append(cur, so), vp.Options.Hooks.Keep) {
+		if err := fss.Delete(o); err != nil {
+			r.failed.Delete++
+			return fmt.Errorf("failed to delete %s: %v", o.FileName(), err)
+		}
+		r.deleted++
+	}
+	return nil
+}
+
+// nameTaken reports whether tmpl names a snapshot of cur like so.
+// Manual snapshots with the same label and expiry are only told apart by the time of their creation, which templates
+// may truncate to minutes or coarser, unlike the schedule which is checked by checkNaming.
+func nameTaken(tmpl *snapobj.Template, so *snapobj.SnapObj, cur []*snapobj.SnapObj) bool {
+	name := tmpl.Format(so)
+	for _, o := range cur {
+		if o.Source == "" && tmpl.Format(o) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAge parses a duration as accepted by time.ParseDuration, or a number of days or weeks such as '14d' or '2w'.
+func parseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for u, d := range units {
+		if !strings.HasSuffix(s, u) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, u))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * d, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+func TestNameTaken(t *testing.T) {
+	minutes, err := snapobj.ParseTemplate("{type}-{2006-01-02_1504}")
+	if err != nil {
+		t.Fatalf("ParseTemplate() = _, %v, want nil", err)
+	}
+	base := time.Date(2026, 10, 19, 14, 17, 0, 0, time.UTC)
+	manual := func(label string, ts time.Time) *snapobj.SnapObj {
+		return &snapobj.SnapObj{Type: snapobj.Manual, Label: label, Epoch: ts}
+	}
+	cur := []*snapobj.SnapObj{
+		manual("x", base),
+		{Type: snapobj.Minutely, Epoch: base.Add(2 * time.Minute)},
+		{Type: snapobj.Manual, Label: "y", Epoch: base.Add(3 * time.Minute), Source: "y"},
+	}
+	tests := []struct {
+		desc string
+		tmpl *snapobj.Template
+		so   *snapobj.SnapObj
+		want bool
+	}{
+		{"same minute", minutes, manual("x", base.Add(30*time.Second)), true},
+		{"next minute", minutes, manual("x", base.Add(time.Minute)), false},
+		{"other label", minutes, manual("y", base), false},
+		{"adopted snapshot", minutes, manual("y", base.Add(3*time.Minute)), false},
+		{"default naming, same second", nil, manual("x", base), true},
+		{"default naming, next second", nil, manual("x", base.Add(time.Second)), false},
+	}
+	for _, tt := range tests {
+		if got := nameTaken(tt.tmpl, tt.so, cur); got != tt.want {
+			t.Errorf("%s: nameTaken() = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/replicate"
+)
+
+// statusEntry describes the replication state of a volume in JSON mode.
+type statusEntry struct {
+	Volume string `json:"volume"`
+	// Target is empty if the volume is not replicated.
+	Target      string `json:"target,omitempty"`
+	Latest      string `json:"latest_common,omitempty"`
+	Pending     int    `json:"pending_streams"`
+	ResumeToken string `json:"resume_token,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// statusMain implements the 'status' command.
+func statusMain(g *globals, args []string) {
+	fl := g.flagSet("status")
+	fl.Parse(args)
+
+	if fl.NArg() == 0 {
+		fl.Usage()
+		xfail("\nNo volumes given, exiting")
+	}
+
+	conf := g.config()
+	// Status never changes anything: open the volumes in dry run mode.
+	e := g.executor()
+	e.DryRun = true
+
+	var failed bool
+	for _, vol := range fl.Args() {
+		vol = filepath.Clean(vol)
+		st, err := status(vol, conf, e)
+		if err != nil {
+			e.Eprintf("volume %s: %v\n", vol, err)
+			st.Error = err.Error()
+			failed = true
+		}
+		if g.json {
+			printJSON(st)
+		} else if err == nil {
+			printStatus(e, st)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// status returns the replication state of a single volume. The volume of the returned entry is set even on error.
+func status(vol string, conf VolPolicy, e *exec.Exec) (*statusEntry, error) {
+	se := &statusEntry{Volume: vol}
+	vp, ok := conf[vol]
+	if !ok {
+		return se, fmt.Errorf("not defined in config")
+	}
+	if vp.Options.Replicate == nil {
+		return se, nil
+	}
+
+	fss, err := fs.ForVolume(vol, vp.Options, e)
+	if err != nil {
+		return se, fmt.Errorf("failed to open volume: %v", err)
+	}
+	snd, ok := fss.(fs.Sender)
+	if !ok {
+		return se, fmt.Errorf("%s does not support replication", fss.Description())
+	}
+	r, err := replicate.New(snd, vp.Options.Replicate, e)
+	if err != nil {
+		return se, err
+	}
+	st, err := r.Status()
+	if err != nil {
+		return se, err
+	}
+	se.Target, se.Latest, se.Pending, se.ResumeToken = st.Target, st.Latest, st.Pending, st.ResumeToken
+	return se, nil
+}
+
+// printStatus prints st in human readable form.
+func printStatus(e *exec.Exec, st *statusEntry) {
+	if st.Target == "" {
+		e.Printf("%s: no replication configured\n", st.Volume)
+		return
+	}
+	latest := st.Latest
+	if latest == "" {
+		latest = "none"
+	}
+	e.Printf("%s -> %s\n", st.Volume, st.Target)
+	e.Printf("  latest common snapshot: %s\n", latest)
+	e.Printf("  pending streams:        %d\n", st.Pending)
+	if st.ResumeToken == "" {
+		e.Printf("  interrupted stream:     none\n")
+	} else {
+		e.Printf("  interrupted stream:     resumable, token %s\n", abbrev(st.ResumeToken, 24))
+	}
+}
+
+// abbrev shortens s to at most n characters.
+func abbrev(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
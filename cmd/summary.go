@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// exitFailure is returned if all volumes failed, or on usage errors.
+	exitFailure = 1
+	// exitPartial is returned if some, but not all volumes failed.
+	exitPartial = 2
+)
+
+// result summarizes the run of a single volume.
+type result struct {
+	vol     string
+	created int
+	deleted int
+	failed  failures
+	err     error
+}
+
+// failures counts the failed operations of a volume per phase. Snapshot and Delete count snapshots,
+// Replication and Archive count failed runs of the respective phase.
+type failures struct {
+	Snapshot    int `json:"snapshot"`
+	Replication int `json:"replication"`
+	Archive     int `json:"archive"`
+	Delete      int `json:"delete"`
+}
+
+// String returns the non-zero counts, e.g. 'snapshot 1, delete 2', or '-' if nothing failed.
+func (f failures) String() string {
+	var s []string
+	for _, c := range []struct {
+		phase string
+		n     int
+	}{{"snapshot", f.Snapshot}, {"replication", f.Replication}, {"archive", f.Archive}, {"delete", f.Delete}} {
+		if c.n > 0 {
+			s = append(s, fmt.Sprintf("%s %d", c.phase, c.n))
+		}
+	}
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.Join(s, ", ")
+}
+
+// jsonSummary is printed for each volume at the end of a run in JSON mode.
+type jsonSummary struct {
+	Event   string   `json:"event"`
+	Volume  string   `json:"volume"`
+	Created int      `json:"created"`
+	Deleted int      `json:"deleted"`
+	Failed  failures `json:"failed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// printSummary prints a table of the results of a run.
+func printSummary(results []*result, jsonOut bool) {
+	if jsonOut {
+		for _, r := range results {
+			js := jsonSummary{Event: "summary", Volume: r.vol, Created: r.created, Deleted: r.deleted, Failed: r.failed}
+			if r.err != nil {
+				js.Error = r.err.Error()
+			}
+			printJSON(js)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nVOLUME\tCREATED\tDELETED\tFAILED\tSTATUS\n")
+	for _, r := range results {
+		st := "ok"
+		if r.err != nil {
+			st = fmt.Sprintf("failed: %v", r.err)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", r.vol, r.created, r.deleted, r.failed, st)
+	}
+	tw.Flush()
+}
+
+// exitCode returns the exit code of a run, distinguishing partial from total failure.
+func exitCode(results []*result) int {
+	var failed int
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return 0
+	case failed == len(results):
+		return exitFailure
+	}
+	return exitPartial
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/adrian-bl/minisnap/lib/archive"
+	"github.com/adrian-bl/minisnap/lib/lock"
+	"github.com/adrian-bl/minisnap/lib/replicate"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// calendars maps the smallest snapshot type of a volume to the OnCalendar value of its timer.
+// Snapshots become due once their predecessor of the same type is a full period old: a timer firing exactly
+// once per period would race with that and skip every other snapshot, so timers fire several times per period.
+var calendars = []struct {
+	typ snapobj.Type
+	cal string
+}{
+	{snapobj.Minutely, "minutely"},
+	{snapobj.Hourly, "*:0/5"},
+	{snapobj.Daily, "hourly"},
+	{snapobj.Weekly, "*-*-* 0/6:00:00"},
+	{snapobj.Monthly, "daily"},
+	{snapobj.Yearly, "daily"},
+}
+
+// systemdMain implements the 'systemd-units' command.
+func systemdMain(g *globals, args []string) {
+	fl := g.flagSet("systemd-units")
+	output := fl.String("output", "", "directory to write the units to, e.g. /etc/systemd/system")
+	msnap := fl.String("msnap", "", "path of the msnap binary invoked by the units, defaults to this binary")
+	fl.Parse(args)
+
+	if *output == "" {
+		fl.Usage()
+		xfail("\nNo -output directory given, exiting")
+	}
+	if *msnap == "" {
+		p, err := os.Executable()
+		if err != nil {
+			xfail("failed to find msnap binary, use -msnap: %v", err)
+		}
+		*msnap = p
+	}
+	confFile, err := filepath.Abs(g.confFile)
+	if err != nil {
+		xfail("%v", err)
+	}
+	lockDir, err := filepath.Abs(g.lockDir)
+	if err != nil {
+		xfail("%v", err)
+	}
+
+	conf := g.config()
+	vols := make([]string, 0, len(conf))
+	for vol := range conf {
+		vols = append(vols, vol)
+	}
+	sort.Strings(vols)
+
+	if !g.dryRun {
+		if err := os.MkdirAll(*output, 0755); err != nil {
+			xfail("%v", err)
+		}
+	}
+	for _, vol := range vols {
+		cal := calendar(conf[vol].Schedule)
+		if cal == "" {
+			fmt.Fprintf(os.Stderr, "Warning: skipping volume %s: schedule keeps no snapshots\n", vol)
+			continue
+		}
+		name := unitName(vol)
+		units := map[string]string{
+			name + ".service": serviceUnit(vol, conf[vol], *msnap, confFile, lockDir),
+			name + ".timer":   timerUnit(vol, cal),
+		}
+		for _, fn := range []string{name + ".service", name + ".timer"} {
+			path := filepath.Join(*output, fn)
+			if g.dryRun {
+				fmt.Printf("Would write %s:\n%s\n", path, units[fn])
+				continue
+			}
+			if err := ioutil.WriteFile(path, []byte(units[fn]), 0644); err != nil {
+				xfail("%v", err)
+			}
+			fmt.Printf("Wrote %s\n", path)
+		}
+	}
+}
+
+// calendar returns the OnCalendar value for the smallest snapshot type kept by schedule, or an empty string.
+func calendar(schedule map[snapobj.Type]int) string {
+	for _, c := range calendars {
+		if schedule[c.typ] > 0 {
+			return c.cal
+		}
+	}
+	return ""
+}
+
+// serviceUnit returns the service running msnap on vol, using the lock files in lockDir.
+func serviceUnit(vol string, vp *VolPolicyEntry, msnap, confFile, lockDir string) string {
+	// The volume holds the btrfs snapshot directory, local targets receive streams.
+	rw := []string{vol}
+	if ro := vp.Options.Replicate; ro != nil {
+		if t, err := replicate.ParseTarget(ro.Target); err == nil && t.Remote == nil && filepath.IsAbs(t.Path) {
+			rw = append(rw, t.Path)
+		}
+	}
+	if ao := vp.Options.Archive; ao != nil {
+		if ao.Dir != "" {
+			rw = append(rw, ao.Dir)
+		}
+		if ao.S3 != nil {
+			sd := ao.S3.StateDir
+			if sd == "" {
+				// The parent of the default, which may not exist yet.
+				sd = archive.StateDir
+			}
+			rw = append(rw, sd)
+		}
+	}
+	// Lock files outside of the runtime directory are passed on, and need to be writable.
+	var flags string
+	if lockDir != lock.DefaultDir {
+		rw = append(rw, lockDir)
+		flags = " -lock_dir " + execArg(lockDir)
+	}
+	for i, p := range rw {
+		// Missing paths are ignored instead of failing the unit.
+		rw[i] = unitQuote("-" + p)
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "[Unit]\n")
+	fmt.Fprintf(b, "Description=minisnap snapshots of %s\n", unitEscape(vol))
+	fmt.Fprintf(b, "After=local-fs.target zfs-mount.service\n")
+	fmt.Fprintf(b, "\n[Service]\n")
+	fmt.Fprintf(b, "Type=oneshot\n")
+	fmt.Fprintf(b, "ExecStart=%s -config %s%s run %s\n", execArg(msnap), execArg(confFile), flags, execArg(vol))
+	fmt.Fprintf(b, "Nice=10\n")
+	fmt.Fprintf(b, "IOSchedulingClass=idle\n")
+	if lockDir == lock.DefaultDir {
+		// Holds the lock files, which are shared by all units.
+		fmt.Fprintf(b, "RuntimeDirectory=%s\n", filepath.Base(lock.DefaultDir))
+		fmt.Fprintf(b, "RuntimeDirectoryPreserve=yes\n")
+	}
+	fmt.Fprintf(b, "ReadWritePaths=%s\n", strings.Join(rw, " "))
+	fmt.Fprintf(b, "ProtectSystem=strict\n")
+	fmt.Fprintf(b, "ProtectHome=read-only\n")
+	fmt.Fprintf(b, "PrivateTmp=yes\n")
+	fmt.Fprintf(b, "NoNewPrivileges=yes\n")
+	fmt.Fprintf(b, "ProtectKernelTunables=yes\n")
+	fmt.Fprintf(b, "ProtectKernelModules=yes\n")
+	fmt.Fprintf(b, "ProtectControlGroups=yes\n")
+	fmt.Fprintf(b, "RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6\n")
+	fmt.Fprintf(b, "RestrictNamespaces=yes\n")
+	fmt.Fprintf(b, "RestrictRealtime=yes\n")
+	fmt.Fprintf(b, "RestrictSUIDSGID=yes\n")
+	fmt.Fprintf(b, "LockPersonality=yes\n")
+	fmt.Fprintf(b, "MemoryDenyWriteExecute=yes\n")
+	fmt.Fprintf(b, "SystemCallArchitectures=native\n")
+	return b.String()
+}
+
+// timerUnit returns the timer starting the service of vol.
+func timerUnit(vol, cal string) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "[Unit]\n")
+	fmt.Fprintf(b, "Description=Periodic minisnap snapshots of %s\n", unitEscape(vol))
+	fmt.Fprintf(b, "\n[Timer]\n")
+	fmt.Fprintf(b, "OnCalendar=%s\n", cal)
+	fmt.Fprintf(b, "Persistent=true\n")
+	fmt.Fprintf(b, "\n[Install]\n")
+	fmt.Fprintf(b, "WantedBy=timers.target\n")
+	return b.String()
+}
+
+// unitName returns the unit name of vol without suffix, escaped like 'systemd-escape --path'.
+func unitName(vol string) string {
+	p := strings.Trim(filepath.Clean(vol), "/")
+	if p == "" {
+		return "msnap--"
+	}
+	b := &strings.Builder{}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "msnap-" + b.String()
+}
+
+// unitEscape escapes the specifiers systemd would expand in s.
+func unitEscape(s string) string {
+	return strings.Replace(s, "%", "%%", -1)
+}
+
+// unitQuote escapes s like unitEscape and quotes it if required, so that systemd reads it as a single
+// word, e.g. of ReadWritePaths.
+func unitQuote(s string) string {
+	s = unitEscape(s)
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(s) + `"`
+}
+
+// execArg quotes s as a single argument of ExecStart, which also expands environment variables.
+func execArg(s string) string {
+	return unitQuote(strings.Replace(s, "$", "$$", -1))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/adrian-bl/minisnap/lib/lock"
+	"github.com/adrian-bl/minisnap/lib/opts"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExecArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{arg: "/tank/foo", want: "/tank/foo"},
+		{arg: "/mnt/my disk", want: `"/mnt/my disk"`},
+		{arg: "/mnt/100%", want: "/mnt/100%%"},
+		{arg: "/mnt/$HOME", want: "/mnt/$$HOME"},
+		{arg: `/mnt/a"b\c d`, want: `"/mnt/a\"b\\c d"`},
+		{arg: ";", want: `";"`},
+		{arg: "", want: `""`},
+	}
+	for _, tt := range tests {
+		if got := execArg(tt.arg); got != tt.want {
+			t.Errorf("execArg(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestCalendar(t *testing.T) {
+	tests := []struct {
+		schedule map[snapobj.Type]int
+		want     string
+	}{
+		{schedule: map[snapobj.Type]int{snapobj.Minutely: 60, snapobj.Daily: 7}, want: "minutely"},
+		{schedule: map[snapobj.Type]int{snapobj.Hourly: 24, snapobj.Daily: 7}, want: "*:0/5"},
+		{schedule: map[snapobj.Type]int{snapobj.Hourly: 0, snapobj.Daily: 7}, want: "hourly"},
+		{schedule: map[snapobj.Type]int{snapobj.Weekly: 4}, want: "*-*-* 0/6:00:00"},
+		{schedule: map[snapobj.Type]int{snapobj.Yearly: 1}, want: "daily"},
+		{schedule: map[snapobj.Type]int{snapobj.Daily: 0}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := calendar(tt.schedule); got != tt.want {
+			t.Errorf("calendar(%v) = %q, want %q", tt.schedule, got, tt.want)
+		}
+	}
+}
+
+func TestUnitName(t *testing.T) {
+	tests := []struct {
+		vol  string
+		want string
+	}{
+		{vol: "/", want: "msnap--"},
+		{vol: "/tank/foo", want: "msnap-tank-foo"},
+		{vol: "/tank/foo/", want: "msnap-tank-foo"},
+		{vol: "/tank/my-vm", want: `msnap-tank-my\x2dvm`},
+		{vol: "/srv/.hidden", want: "msnap-srv-.hidden"},
+		{vol: "/.snapshots", want: `msnap-\x2esnapshots`},
+		{vol: "/mnt/my disk", want: `msnap-mnt-my\x20disk`},
+	}
+	for _, tt := range tests {
+		if got := unitName(tt.vol); got != tt.want {
+			t.Errorf("unitName(%q) = %s, want %s", tt.vol, got, tt.want)
+		}
+	}
+}
+
+// hardening holds the sandboxing lines shared by all services.
+const hardening = `ProtectSystem=strict
+ProtectHome=read-only
+PrivateTmp=yes
+NoNewPrivileges=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectControlGroups=yes
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+`
+
+func TestServiceUnit(t *testing.T) {
+	tests := []struct {
+		desc    string
+		vol     string
+		opts    opts.VolOptions
+		lockDir string
+		want    string
+	}{
+		{
+			desc:    "plain",
+			vol:     "/tank/foo",
+			lockDir: lock.DefaultDir,
+			want: `[Unit]
+Description=minisnap snapshots of /tank/foo
+After=local-fs.target zfs-mount.service
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/msnap -config /etc/minisnap.conf run /tank/foo
+Nice=10
+IOSchedulingClass=idle
+RuntimeDirectory=minisnap
+RuntimeDirectoryPreserve=yes
+ReadWritePaths=-/tank/foo
+` + hardening,
+		},
+		{
+			desc: "targets and lock dir",
+			vol:  "/mnt/100% disk",
+			opts: opts.VolOptions{
+				Replicate: &opts.Replicate{Target: "/backup/foo"},
+				Archive:   &opts.Archive{S3: &opts.S3{Bucket: "b"}},
+			},
+			lockDir: "/var/lock/msnap",
+			want: `[Unit]
+Description=minisnap snapshots of /mnt/100%% disk
+After=local-fs.target zfs-mount.service
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/msnap -config /etc/minisnap.conf -lock_dir /var/lock/msnap run "/mnt/100%% disk"
+Nice=10
+IOSchedulingClass=idle
+ReadWritePaths="-/mnt/100%% disk" -/backup/foo -/var/lib/minisnap -/var/lock/msnap
+` + hardening,
+		},
+		{
+			desc:    "remote target and archive directory",
+			vol:     "/tank/foo",
+			opts:    opts.VolOptions{Replicate: &opts.Replicate{Target: "ssh://backup/tank/foo"}, Archive: &opts.Archive{Dir: "/mnt/usb"}},
+			lockDir: lock.DefaultDir,
+			want: `[Unit]
+Description=minisnap snapshots of /tank/foo
+After=local-fs.target zfs-mount.service
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/msnap -config /etc/minisnap.conf run /tank/foo
+Nice=10
+IOSchedulingClass=idle
+RuntimeDirectory=minisnap
+RuntimeDirectoryPreserve=yes
+ReadWritePaths=-/tank/foo -/mnt/usb
+` + hardening,
+		},
+	}
+	for _, tt := range tests {
+		got := serviceUnit(tt.vol, &VolPolicyEntry{Options: tt.opts}, "/usr/bin/msnap", "/etc/minisnap.conf", tt.lockDir)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: serviceUnit() mismatch (-want +got)\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestTimerUnit(t *testing.T) {
+	want := `[Unit]
+Description=Periodic minisnap snapshots of /mnt/100%% disk
+
+[Timer]
+OnCalendar=*:0/5
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`
+	if diff := cmp.Diff(want, timerUnit("/mnt/100% disk", "*:0/5")); diff != "" {
+		t.Errorf("timerUnit() mismatch (-want +got)\n%s", diff)
+	}
+}
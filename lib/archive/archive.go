@@ -0,0 +1,324 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/opts"
+	"github.com/adrian-bl/minisnap/lib/policy"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// Archiver writes send streams of a volume into a store.
+type Archiver struct {
+	src       fs.Sender
+	store     Store
+	exec      *exec.Exec
+	compress  string
+	fullEvery int
+	types     map[snapobj.Type]bool
+	// Template of the local snapshot names, nil for the legacy format.
+	naming *snapobj.Template
+}
+
+func New(src fs.Sender, store Store, ao *opts.Archive, e *exec.Exec) (*Archiver, error) {
+	if _, ok := exec.Compressors[ao.Compress]; !ok && ao.Compress != "" {
+		return nil, fmt.Errorf("unknown compression '%s'", ao.Compress)
+	}
+	if ao.FullEvery < 0 {
+		return nil, fmt.Errorf("full_every must not be negative")
+	}
+
+	types := make(map[snapobj.Type]bool)
+	for _, t := range ao.Types {
+		st, err := snapobj.ToType(t)
+		if err != nil {
+			return nil, fmt.Errorf("archive type '%s': %v", t, err)
+		}
+		types[st] = true
+	}
+
+	a := &Archiver{
+		src:       src,
+		store:     store,
+		exec:      e,
+		compress:  ao.Compress,
+		fullEvery: ao.FullEvery,
+		types:     types,
+	}
+	if n, ok := src.(fs.Namer); ok {
+		a.naming = n.Naming()
+	}
+	return a, nil
+}
+
+// Run archives the most recent snapshot and prunes the archive according to p.
+func (a *Archiver) Run(p *policy.Policy) error {
+	m, err := LoadManifest(a.store)
+	if err != nil {
+		return fmt.Errorf("failed to load manifest: %v", err)
+	}
+	if m.Kind == "" {
+		m.Kind = a.src.Kind()
+	}
+	if m.Kind != a.src.Kind() {
+		return fmt.Errorf("archive %s contains %s streams, refusing to add %s streams", a.store, m.Kind, a.src.Kind())
+	}
+
+	local, err := a.src.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather local snapshots: %v", err)
+	}
+	local = a.filter(local)
+	var s *snapobj.SnapObj
+	for i, o := range local {
+		if !o.Adopted() {
+			s, local = o, local[:i+1]
+		}
+	}
+
+	if s != nil && m.Match(a.naming, s) == nil {
+		base := Base(m, local, a.fullEvery, a.naming)
+		if err := a.write(m, base, s, p.Now); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", s.FileName(), err)
+		}
+	} else {
+		a.exec.Printf("Archive %s is up to date\n", a.store)
+	}
+
+	return a.prune(m, p)
+}
+
+// filter returns the snapshots eligible for archiving, sorted by age.
+// Adopted snapshots are only used as base until they are migrated, as their names may still change.
+func (a *Archiver) filter(s []*snapobj.SnapObj) []*snapobj.SnapObj {
+	r := make([]*snapobj.SnapObj, 0, len(s))
+	for _, o := range s {
+		if len(a.types) == 0 || a.types[o.Type] {
+			r = append(r, o)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Epoch.Equal(r[j].Epoch) {
+			return r[i].FileName() < r[j].FileName()
+		}
+		return r[i].Epoch.Before(r[j].Epoch)
+	})
+	return r
+}
+
+// write archives s, incremental to base if non-nil, and records it in the manifest.
+func (a *Archiver) write(m *Manifest, base, s *snapobj.SnapObj, now time.Time) error {
+	e := &Entry{
+		Name:     s.FileName(),
+		File:     StreamName(s, base != nil, a.compress),
+		Compress: a.compress,
+		Created:  now,
+	}
+	if base != nil {
+		e.Parent = m.Match(a.naming, base).Name
+		a.exec.Printf("Archiving %s to %s, incremental from %s\n", e.Name, a.store, e.Parent)
+	} else {
+		a.exec.Printf("Archiving %s to %s\n", e.Name, a.store)
+	}
+
+	cmds := []exec.Cmd{a.src.Send(base, s)}
+	if c, ok := exec.Compressors[a.compress]; ok {
+		cmds = append(cmds, c.Compress)
+	}
+	if a.exec.DryRun {
+		return a.exec.ReadFrom(cmds, nil)
+	}
+
+	err := a.exec.ReadFrom(cmds, func(r io.Reader) error {
+		cr := newCountingReader(r)
+		put := a.store.Put
+		if ss, ok := a.store.(StreamStore); ok {
+			put = func(name string, r io.Reader) error { return ss.PutStream(name, e.Parent, r) }
+		}
+		if err := put(e.File, cr); err != nil {
+			return err
+		}
+		e.Size, e.SHA256 = cr.n, cr.Sum()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.Entries = append(m.Entries, e)
+	return m.Save(a.store)
+}
+
+// prune removes all streams which are expired according to p and not needed by any remaining stream.
+func (a *Archiver) prune(m *Manifest, p *policy.Policy) error {
+	snaps, err := m.Snapshots()
+	if err != nil {
+		return err
+	}
+	// Snapshots due locally are not archived yet, so they must not replace any archived ones.
+	plan, err := p.Prune(snaps)
+	if err != nil {
+		return err
+	}
+
+	drop := make([]*snapobj.SnapObj, 0)
+	for _, o := range plan {
+		if o.Delete {
+			drop = append(drop, o.Target)
+		}
+	}
+	removed := m.Prune(drop)
+	if len(removed) == 0 {
+		return nil
+	}
+
+	for _, e := range removed {
+		if a.exec.DryRun {
+			a.exec.Printf("Would remove %s from %s\n", e.File, a.store)
+		} else {
+			a.exec.Printf("Removing %s from %s\n", e.File, a.store)
+		}
+	}
+	if a.exec.DryRun {
+		return nil
+	}
+	// Update the manifest first: a stale file is harmless, a missing one is not.
+	if err := m.Save(a.store); err != nil {
+		return err
+	}
+	for _, e := range removed {
+		if err := a.store.Remove(e.File); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Base returns the snapshot to use as base of the next incremental stream, nil if a full stream should be written.
+// The base is the most recent archived snapshot still present locally. A full stream is also requested once
+// the chain leading to the base contains fullEvery incremental streams. Snapshots are matched using Manifest.Match.
+func Base(m *Manifest, local []*snapobj.SnapObj, fullEvery int, tmpl *snapobj.Template) *snapobj.SnapObj {
+	for i := len(local) - 1; i >= 0; i-- {
+		e := m.Match(tmpl, local[i])
+		if e == nil {
+			continue
+		}
+		chain, err := m.Chain(e.Name)
+		if err != nil {
+			return nil
+		}
+		if fullEvery > 0 && len(chain)-1 >= fullEvery {
+			return nil
+		}
+		return local[i]
+	}
+	return nil
+}
+
+// StreamName returns the file name used for a stream of s.
+// Colons are avoided as they are not supported by FAT formatted disks.
+func StreamName(s *snapobj.SnapObj, incremental bool, compress string) string {
+	kind := "full"
+	if incremental {
+		kind = "incr"
+	}
+	t := s.Type.String()
+	if s.Type == snapobj.Manual {
+		t += "-" + s.Label
+	}
+	n := fmt.Sprintf("%s-%s.%s", t, s.Epoch.UTC().Format("20060102T150405Z"), kind)
+	if c, ok := exec.Compressors[compress]; ok {
+		n += c.Ext
+	}
+	return n
+}
+
+// Restore replays the chain leading to the snapshot name (or the latest one if empty) into dest.
+func Restore(store Store, name, dest string, e *exec.Exec) error {
+	m, err := LoadManifest(store)
+	if err != nil {
+		return fmt.Errorf("failed to load manifest: %v", err)
+	}
+	if name == "" {
+		l := m.Latest()
+		if l == nil {
+			return fmt.Errorf("archive %s is empty", store)
+		}
+		name = l.Name
+	}
+	chain, err := m.Chain(name)
+	if err != nil {
+		return err
+	}
+	// Restoring only receives streams, so the naming of the snapshots does not matter.
+	recv, err := fs.NewReceiver(m.Kind, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, en := range chain {
+		e.Printf("Restoring %s from %s into %s\n", en.Name, en.File, dest)
+		if err := replay(store, en, recv.Receive(dest), e); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", en.Name, err)
+		}
+	}
+	return nil
+}
+
+// replay feeds a single stream into rcmd.
+func replay(store Store, en *Entry, rcmd exec.Cmd, e *exec.Exec) error {
+	cmds := []exec.Cmd{rcmd}
+	if en.Compress != "" {
+		c, ok := exec.Compressors[en.Compress]
+		if !ok {
+			return fmt.Errorf("unknown compression '%s'", en.Compress)
+		}
+		cmds = append([]exec.Cmd{c.Decompress}, cmds...)
+	}
+
+	fh, err := store.Get(en.File)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	cr := newCountingReader(fh)
+	if err := e.WriteTo(cmds, cr); err != nil {
+		return err
+	}
+	if !e.DryRun && cr.Sum() != en.SHA256 {
+		return fmt.Errorf("checksum mismatch in %s: got %s, want %s", en.File, cr.Sum(), en.SHA256)
+	}
+	return nil
+}
+
+// countingReader tracks the size and checksum of the data read through it.
+type countingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func newCountingReader(r io.Reader) *countingReader {
+	return &countingReader{r: r, h: sha256.New()}
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.h.Write(b[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// Sum returns the hex encoded SHA256 of all data read so far.
+func (c *countingReader) Sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
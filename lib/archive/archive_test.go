@@ -0,0 +1,206 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/policy"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeSender emits the snapshot and base name as stream.
+type fakeSender struct {
+	snaps []*snapobj.SnapObj
+}
+
+func (f *fakeSender) Description() string                 { return "fake" }
+func (f *fakeSender) Gather() ([]*snapobj.SnapObj, error) { return f.snaps, nil }
+func (f *fakeSender) Create(*snapobj.SnapObj) error       { return nil }
+func (f *fakeSender) Delete(*snapobj.SnapObj) error       { return nil }
+func (f *fakeSender) Kind() string                        { return "fake" }
+func (f *fakeSender) Send(base, s *snapobj.SnapObj) exec.Cmd {
+	b := "-"
+	if base != nil {
+		b = base.FileName()
+	}
+	return exec.Cmd{Name: "echo", Args: []string{b, s.FileName()}}
+}
+
+func TestArchiveAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &fakeSender{}
+	a := &Archiver{src: src, store: store, exec: &exec.Exec{}, fullEvery: 2}
+	p := &policy.Policy{
+		Now:  time.Unix(90000123, 0).UTC(),
+		Keep: map[snapobj.Type]int{snapobj.Hourly: 2},
+	}
+
+	for _, s := range []string{"hourly@1972-11-07T14:00:00Z", "hourly@1972-11-07T15:00:00Z", "hourly@1972-11-07T16:00:00Z"} {
+		src.snaps = append(src.snaps, sof(s))
+		if err := a.Run(p); err != nil {
+			t.Fatalf("Run() = %v, want nil", err)
+		}
+	}
+
+	m, err := LoadManifest(store)
+	if err != nil {
+		t.Fatalf("LoadManifest() = _, %v, want nil", err)
+	}
+	// The full stream of 14:00 is needed by the kept incremental of 15:00.
+	if len(m.Entries) != 3 {
+		t.Fatalf("manifest has %d entries, want 3", len(m.Entries))
+	}
+	chain, err := m.Chain("hourly@1972-11-07T16:00:00Z")
+	if err != nil {
+		t.Fatalf("Chain() = _, %v, want nil", err)
+	}
+	if len(chain) != 3 {
+		t.Errorf("Chain() returned %d entries, want 3", len(chain))
+	}
+
+	out := filepath.Join(dir, "replayed")
+	recv := exec.Cmd{Name: "sh", Args: []string{"-c", `cat >> "$0"`, out}}
+	for _, en := range chain {
+		if err := replay(store, en, recv, &exec.Exec{}); err != nil {
+			t.Fatalf("replay(%s) = %v, want nil", en.Name, err)
+		}
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "- hourly@1972-11-07T14:00:00Z\n" +
+		"hourly@1972-11-07T14:00:00Z hourly@1972-11-07T15:00:00Z\n" +
+		"hourly@1972-11-07T15:00:00Z hourly@1972-11-07T16:00:00Z\n"
+	if string(got) != want {
+		t.Errorf("replayed chain = %q, want %q", got, want)
+	}
+
+	// Corrupt the tip: replaying it must fail.
+	if err := ioutil.WriteFile(filepath.Join(dir, chain[2].File), []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := replay(store, chain[2], recv, &exec.Exec{}); err == nil {
+		t.Errorf("replay() of corrupted stream = nil, wanted err")
+	}
+}
+
+func TestArchiveNamingEnabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := sof("hourly@1972-11-07T14:00:13Z")
+	src := &fakeSender{snaps: []*snapobj.SnapObj{legacy}}
+	a := &Archiver{src: src, store: store, exec: &exec.Exec{}}
+	p := &policy.Policy{
+		Now:  time.Date(1972, 11, 7, 16, 0, 30, 0, time.UTC),
+		Keep: map[snapobj.Type]int{snapobj.Hourly: 5},
+	}
+	if err := a.Run(p); err != nil {
+		t.Fatalf("Run() = %v, want nil", err)
+	}
+
+	// Naming is enabled, the existing snapshot is adopted until it is migrated.
+	if a.naming, err = snapobj.ParseTemplate("{type}-{2006-01-02_1504}"); err != nil {
+		t.Fatalf("ParseTemplate() = _, %v, want nil", err)
+	}
+	named := func(n string) *snapobj.SnapObj {
+		so, err := a.naming.Parse(n)
+		if err != nil {
+			t.Fatalf("Parse(%s) = _, %v, want nil", n, err)
+		}
+		return so
+	}
+	adopted := *legacy
+	adopted.Source = "msnap_hourly::1972-11-07T14:00:13Z"
+	src.snaps = []*snapobj.SnapObj{&adopted, named("hourly-1972-11-07_1500")}
+	if err := a.Run(p); err != nil {
+		t.Fatalf("Run() = %v, want nil", err)
+	}
+	// After migrating, the names no longer contain seconds.
+	src.snaps = []*snapobj.SnapObj{named("hourly-1972-11-07_1400"), named("hourly-1972-11-07_1500"), named("hourly-1972-11-07_1600")}
+	if err := a.Run(p); err != nil {
+		t.Fatalf("Run() = %v, want nil", err)
+	}
+
+	m, err := LoadManifest(store)
+	if err != nil {
+		t.Fatalf("LoadManifest() = _, %v, want nil", err)
+	}
+	var got [][2]string
+	for _, e := range m.Entries {
+		got = append(got, [2]string{e.Name, e.Parent})
+	}
+	want := [][2]string{
+		{"hourly@1972-11-07T14:00:13Z", ""},
+		{"hourly@1972-11-07T15:00:00Z", "hourly@1972-11-07T14:00:13Z"},
+		{"hourly@1972-11-07T16:00:00Z", "hourly@1972-11-07T15:00:00Z"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("archived entries mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestPruneLagging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Kind: "fake"}
+	for _, s := range []string{"hourly@1972-11-07T13:00:00Z", "hourly@1972-11-07T14:00:00Z", "hourly@1972-11-07T15:00:00Z"} {
+		e := &Entry{Name: s, File: StreamName(sof(s), false, "")}
+		if err := store.Put(e.File, strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	a := &Archiver{src: &fakeSender{}, store: store, exec: &exec.Exec{}}
+	// The snapshot of 16:00 is due, but not archived yet.
+	p := &policy.Policy{
+		Now:  time.Date(1972, 11, 7, 16, 0, 30, 0, time.UTC),
+		Keep: map[snapobj.Type]int{snapobj.Hourly: 2},
+	}
+	if err := a.prune(m, p); err != nil {
+		t.Fatalf("prune() = %v, want nil", err)
+	}
+
+	var got []string
+	for _, e := range m.Entries {
+		got = append(got, e.Name)
+	}
+	want := []string{"hourly@1972-11-07T14:00:00Z", "hourly@1972-11-07T15:00:00Z"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("prune() kept entries mismatch (-want +got)\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(dir, m.Entries[0].File)); err != nil {
+		t.Errorf("kept stream is missing: %v", err)
+	}
+}
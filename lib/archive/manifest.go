@@ -0,0 +1,171 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// ManifestName is the name of the manifest within a store.
+const ManifestName = "manifest.json"
+
+// Entry describes a single stream stored in an archive.
+type Entry struct {
+	// Name of the archived snapshot, as returned by SnapObj.FileName().
+	Name string `json:"name"`
+	// Parent is the name of the base of an incremental stream, empty for full streams.
+	Parent string `json:"parent,omitempty"`
+	// File is the name of the stream within the store.
+	File     string    `json:"file"`
+	Compress string    `json:"compress,omitempty"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Created  time.Time `json:"created"`
+}
+
+// Manifest describes all streams of an archive and how they depend on each other.
+type Manifest struct {
+	// Kind is the stream format, as returned by fs.Sender.Kind().
+	Kind    string   `json:"kind"`
+	Entries []*Entry `json:"entries"`
+}
+
+// LoadManifest reads the manifest of a store, returning an empty manifest if it does not exist yet.
+func LoadManifest(s Store) (*Manifest, error) {
+	fh, err := s.Get(ManifestName)
+	if os.IsNotExist(err) {
+		return &Manifest{Entries: []*Entry{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	pl, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(pl, m); err != nil {
+		return nil, fmt.Errorf("corrupted manifest: %v", err)
+	}
+	return m, nil
+}
+
+// Save writes the manifest to the store.
+func (m *Manifest) Save(s Store) error {
+	pl, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.Put(ManifestName, bytes.NewReader(pl))
+}
+
+// Find returns the entry of the given snapshot, nil if it is not archived.
+func (m *Manifest) Find(name string) *Entry {
+	for _, e := range m.Entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// Match returns the entry of the local snapshot so named by tmpl, nil if it is not archived. Entries keep the
+// names snapshots had when they were archived, so unless so is adopted, an entry matches if tmpl gives it
+// the same name as so. This finds snapshots archived before their names were migrated to tmpl.
+func (m *Manifest) Match(tmpl *snapobj.Template, so *snapobj.SnapObj) *Entry {
+	if so.Adopted() {
+		return m.Find(so.FileName())
+	}
+	n := tmpl.Format(so)
+	for _, e := range m.Entries {
+		if eo, err := snapobj.FromString(e.Name); err == nil && tmpl.Format(eo) == n {
+			return e
+		}
+	}
+	return nil
+}
+
+// Chain returns the entries which must be replayed in order to restore the given snapshot,
+// starting with a full stream.
+func (m *Manifest) Chain(name string) ([]*Entry, error) {
+	chain := []*Entry{}
+	for name != "" {
+		e := m.Find(name)
+		if e == nil {
+			return nil, fmt.Errorf("snapshot %s is missing from the archive", name)
+		}
+		if len(chain) > len(m.Entries) {
+			return nil, fmt.Errorf("manifest contains a loop at %s", name)
+		}
+		chain = append([]*Entry{e}, chain...)
+		name = e.Parent
+	}
+	return chain, nil
+}
+
+// Latest returns the most recent entry, nil if the manifest is empty.
+func (m *Manifest) Latest() *Entry {
+	var l *Entry
+	for _, e := range m.Entries {
+		if l == nil || e.Created.After(l.Created) {
+			l = e
+		}
+	}
+	return l
+}
+
+// Snapshots returns the snapshot objects of all entries.
+func (m *Manifest) Snapshots() ([]*snapobj.SnapObj, error) {
+	s := make([]*snapobj.SnapObj, 0, len(m.Entries))
+	for _, e := range m.Entries {
+		so, err := snapobj.FromString(e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("entry %s: %v", e.Name, err)
+		}
+		s = append(s, so)
+	}
+	return s, nil
+}
+
+// Prune removes the given snapshots from the manifest and returns the removed entries.
+// Entries which are the base of a remaining incremental stream are kept.
+func (m *Manifest) Prune(drop []*snapobj.SnapObj) []*Entry {
+	want := make(map[string]bool)
+	for _, o := range drop {
+		want[o.FileName()] = true
+	}
+
+	needed := make(map[string]bool)
+	for _, e := range m.Entries {
+		if want[e.Name] {
+			continue
+		}
+		for p := e.Parent; p != "" && !needed[p]; {
+			needed[p] = true
+			pe := m.Find(p)
+			if pe == nil {
+				break
+			}
+			p = pe.Parent
+		}
+	}
+
+	kept := make([]*Entry, 0, len(m.Entries))
+	removed := make([]*Entry, 0)
+	for _, e := range m.Entries {
+		if want[e.Name] && !needed[e.Name] {
+			removed = append(removed, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	m.Entries = kept
+	return removed
+}
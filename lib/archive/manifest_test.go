@@ -0,0 +1,203 @@
+package archive
+
+import (
+	"testing"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func sof(s string) *snapobj.SnapObj {
+	v, err := snapobj.FromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// testManifest returns a manifest with two chains: a-b-c and d-e.
+func testManifest() *Manifest {
+	return &Manifest{
+		Kind: "zfs",
+		Entries: []*Entry{
+			{Name: "hourly@1972-11-07T10:00:00Z"},
+			{Name: "hourly@1972-11-07T11:00:00Z", Parent: "hourly@1972-11-07T10:00:00Z"},
+			{Name: "hourly@1972-11-07T12:00:00Z", Parent: "hourly@1972-11-07T11:00:00Z"},
+			{Name: "hourly@1972-11-07T13:00:00Z"},
+			{Name: "hourly@1972-11-07T14:00:00Z", Parent: "hourly@1972-11-07T13:00:00Z"},
+		},
+	}
+}
+
+func names(e []*Entry) []string {
+	n := []string{}
+	for _, x := range e {
+		n = append(n, x.Name)
+	}
+	return n
+}
+
+func TestChain(t *testing.T) {
+	m := testManifest()
+
+	got, err := m.Chain("hourly@1972-11-07T12:00:00Z")
+	if err != nil {
+		t.Fatalf("Chain() = _, %v, want nil", err)
+	}
+	want := []string{"hourly@1972-11-07T10:00:00Z", "hourly@1972-11-07T11:00:00Z", "hourly@1972-11-07T12:00:00Z"}
+	if diff := cmp.Diff(want, names(got)); diff != "" {
+		t.Errorf("Chain() mismatch (-want +got)\n%s", diff)
+	}
+
+	m.Entries = m.Entries[1:]
+	if _, err := m.Chain("hourly@1972-11-07T12:00:00Z"); err == nil {
+		t.Errorf("Chain() with missing base = _, nil, wanted err")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	input := []struct {
+		name        string
+		drop        []string
+		wantRemoved []string
+	}{
+		{
+			name:        "nothing",
+			wantRemoved: []string{},
+		},
+		{
+			name:        "base of kept incremental",
+			drop:        []string{"hourly@1972-11-07T10:00:00Z", "hourly@1972-11-07T11:00:00Z"},
+			wantRemoved: []string{},
+		},
+		{
+			name:        "whole chain",
+			drop:        []string{"hourly@1972-11-07T10:00:00Z", "hourly@1972-11-07T11:00:00Z", "hourly@1972-11-07T12:00:00Z"},
+			wantRemoved: []string{"hourly@1972-11-07T10:00:00Z", "hourly@1972-11-07T11:00:00Z", "hourly@1972-11-07T12:00:00Z"},
+		},
+		{
+			name:        "tip only",
+			drop:        []string{"hourly@1972-11-07T12:00:00Z", "hourly@1972-11-07T13:00:00Z"},
+			wantRemoved: []string{"hourly@1972-11-07T12:00:00Z"},
+		},
+	}
+
+	for _, tt := range input {
+		m := testManifest()
+		drop := []*snapobj.SnapObj{}
+		for _, d := range tt.drop {
+			drop = append(drop, sof(d))
+		}
+		got := m.Prune(drop)
+		if diff := cmp.Diff(tt.wantRemoved, names(got)); diff != "" {
+			t.Errorf("Prune(%s) mismatch (-want +got)\n%s", tt.name, diff)
+		}
+		if len(got)+len(m.Entries) != 5 {
+			t.Errorf("Prune(%s) left %d entries, want %d", tt.name, len(m.Entries), 5-len(got))
+		}
+	}
+}
+
+func TestBase(t *testing.T) {
+	m := testManifest()
+	local := []*snapobj.SnapObj{
+		sof("hourly@1972-11-07T11:00:00Z"),
+		sof("hourly@1972-11-07T12:00:00Z"),
+		sof("hourly@1972-11-07T15:00:00Z"),
+	}
+
+	input := []struct {
+		name      string
+		local     []*snapobj.SnapObj
+		fullEvery int
+		tmpl      *snapobj.Template
+		want      *snapobj.SnapObj
+	}{
+		{
+			name:  "newest archived",
+			local: local,
+			want:  sof("hourly@1972-11-07T12:00:00Z"),
+		},
+		{
+			name:      "chain too long",
+			local:     local,
+			fullEvery: 2,
+		},
+		{
+			name:      "chain short enough",
+			local:     local,
+			fullEvery: 3,
+			want:      sof("hourly@1972-11-07T12:00:00Z"),
+		},
+		{
+			name:  "nothing in common",
+			local: local[2:],
+		},
+	}
+
+	for _, tt := range input {
+		got := Base(m, tt.local, tt.fullEvery, tt.tmpl)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("Base(%s) mismatch (-want +got)\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	minutes, err := snapobj.ParseTemplate("{type}-{2006-01-02_1504}")
+	if err != nil {
+		t.Fatalf("ParseTemplate() = _, %v, want nil", err)
+	}
+	m := &Manifest{
+		Entries: []*Entry{
+			{Name: "hourly@1972-11-07T15:00:13Z"},
+			{Name: "manual@1972-11-07T15:20:05Z@x"},
+		},
+	}
+	named := func(n string) *snapobj.SnapObj {
+		so, err := minutes.Parse(n)
+		if err != nil {
+			t.Fatalf("Parse(%s) = _, %v, want nil", n, err)
+		}
+		return so
+	}
+	legacy := sof("hourly@1972-11-07T15:00:13Z")
+	legacy.Source = "msnap_hourly::1972-11-07T15:00:13Z"
+	foreign := sof("hourly@1972-11-07T15:00:00Z")
+	foreign.Source = "autosnap_1972-11-07_15:00:00_hourly"
+
+	input := []struct {
+		name string
+		tmpl *snapobj.Template
+		so   *snapobj.SnapObj
+		want string
+	}{
+		{"default naming", nil, sof("hourly@1972-11-07T15:00:13Z"), "hourly@1972-11-07T15:00:13Z"},
+		{"default naming, other second", nil, sof("hourly@1972-11-07T15:00:00Z"), ""},
+		{"not migrated yet", minutes, legacy, "hourly@1972-11-07T15:00:13Z"},
+		{"migrated", minutes, named("hourly-1972-11-07_1500"), "hourly@1972-11-07T15:00:13Z"},
+		{"migrated manual", minutes, named("manual-1972-11-07_1520_x_never"), "manual@1972-11-07T15:20:05Z@x"},
+		{"other label", minutes, named("manual-1972-11-07_1520_y_never"), ""},
+		{"foreign", minutes, foreign, ""},
+	}
+	for _, tt := range input {
+		got := ""
+		if e := m.Match(tt.tmpl, tt.so); e != nil {
+			got = e.Name
+		}
+		if got != tt.want {
+			t.Errorf("Match(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStreamName(t *testing.T) {
+	s := sof("daily@1997-01-17T16:54:13Z")
+	if got, want := StreamName(s, false, ""), "daily-19970117T165413Z.full"; got != want {
+		t.Errorf("StreamName() = %s, want %s", got, want)
+	}
+	if got, want := StreamName(s, true, "zstd"), "daily-19970117T165413Z.incr.zst"; got != want {
+		t.Errorf("StreamName() = %s, want %s", got, want)
+	}
+}
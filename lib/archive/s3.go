@@ -0,0 +1,385 @@
+package archive
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/opts"
+	"github.com/adrian-bl/minisnap/lib/s3"
+	"github.com/adrian-bl/minisnap/lib/stream"
+)
+
+// StateDir holds the state kept by msnap between runs, such as the default state_dir of S3 archives.
+const StateDir = "/var/lib/minisnap"
+
+const (
+	defaultPartSize = 64 << 20
+	// S3 rejects parts smaller than 5MiB, except for the last one.
+	minPartSize     = 5 << 20
+	defaultStateDir = StateDir + "/s3"
+)
+
+// S3 stores streams as objects in an S3 bucket, using multipart uploads which
+// can be resumed after an interruption.
+type S3 struct {
+	client   *s3.Client
+	prefix   string
+	partSize int
+	key      []byte
+	stateDir string
+	exec     *exec.Exec
+}
+
+// uploadState records an unfinished multipart upload.
+type uploadState struct {
+	Object   string `json:"object"`
+	UploadID string `json:"upload_id"`
+	// Base is the base snapshot of an incremental stream.
+	Base string `json:"base,omitempty"`
+	Salt []byte `json:"salt,omitempty"`
+	// Digests cover all data which parts may have been derived from.
+	Digests []checkpoint `json:"digests,omitempty"`
+}
+
+// checkpoint is the SHA256 of the data of a stream up to Offset.
+type checkpoint struct {
+	Offset int64  `json:"offset"`
+	SHA256 string `json:"sha256"`
+}
+
+// errChanged is returned by a verifier once the data differs from the checkpoints of the interrupted upload.
+var errChanged = errors.New("stream differs from the interrupted upload")
+
+// verifier passes on the data of r in chunks of a fixed size, recording a checkpoint at the end of each chunk.
+// A chunk is only passed on once its checkpoint matches the one saved by the interrupted upload, if any.
+type verifier struct {
+	r     io.Reader
+	h     hash.Hash
+	buf   []byte
+	out   []byte
+	off   int64
+	saved []checkpoint
+	sums  []checkpoint
+	err   error
+}
+
+func newVerifier(r io.Reader, size int, saved []checkpoint) *verifier {
+	return &verifier{r: r, h: sha256.New(), buf: make([]byte, size), saved: saved}
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	for len(v.out) == 0 {
+		if v.err != nil {
+			return 0, v.err
+		}
+		n, err := io.ReadFull(v.r, v.buf)
+		switch {
+		case err == io.EOF:
+			// The interrupted upload must not have seen more data.
+			v.err = io.EOF
+			if len(v.sums) < len(v.saved) {
+				v.err = errChanged
+			}
+			continue
+		case err == io.ErrUnexpectedEOF:
+			v.err = io.EOF
+		case err != nil:
+			v.err = err
+			continue
+		}
+		v.h.Write(v.buf[:n])
+		v.off += int64(n)
+		c := checkpoint{Offset: v.off, SHA256: hex.EncodeToString(v.h.Sum(nil))}
+		if i := len(v.sums); i < len(v.saved) && v.saved[i] != c {
+			v.err = errChanged
+			continue
+		}
+		v.sums = append(v.sums, c)
+		v.out = v.buf[:n]
+	}
+	n := copy(p, v.out)
+	v.out = v.out[n:]
+	return n, nil
+}
+
+func NewS3(o *opts.S3, e *exec.Exec) (*S3, error) {
+	ak, sk := o.AccessKey, o.SecretKey
+	if ak == "" {
+		ak = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if sk == "" {
+		sk = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	c, err := s3.New(o.Endpoint, o.Region, o.Bucket, ak, sk)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &S3{
+		client:   c,
+		prefix:   o.Prefix,
+		partSize: defaultPartSize,
+		stateDir: o.StateDir,
+		exec:     e,
+	}
+	if o.PartSize != "" {
+		ps, err := stream.ParseSize(o.PartSize)
+		if err != nil {
+			return nil, err
+		}
+		if ps < minPartSize {
+			return nil, fmt.Errorf("part_size must be at least %s", stream.FormatSize(minPartSize))
+		}
+		s.partSize = int(ps)
+	}
+	if s.stateDir == "" {
+		s.stateDir = defaultStateDir
+	}
+	if o.EncryptionKeyFile != "" {
+		if s.key, err = stream.ReadKey(o.EncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *S3) Put(name string, r io.Reader) error {
+	return s.PutStream(name, "", r)
+}
+
+// PutStream stores r as name like Put. An interrupted upload of name is only resumed if it has the same base
+// and its data matches r: encrypting different data with the salt of the interrupted upload would reuse its
+// key and nonces. Otherwise, the interrupted upload is aborted and started over using a fresh salt.
+func (s *S3) PutStream(name, base string, r io.Reader) error {
+	obj := s.object(name)
+	st, err := s.loadState(obj)
+	if err != nil {
+		return err
+	}
+	if st != nil && (st.Base != base || len(st.Digests) == 0 || (s.key != nil && len(st.Salt) != stream.SaltSize)) {
+		s.exec.Printf("Discarding interrupted upload of %s\n", obj)
+		if err := s.discard(st); err != nil {
+			return err
+		}
+		st = nil
+	}
+	var saved []checkpoint
+	if st != nil {
+		saved = st.Digests
+	}
+	v := newVerifier(r, s.partSize, saved)
+	r = v
+
+	var salt []byte
+	if s.key != nil {
+		if st != nil {
+			// The verifier only passes on data matching the interrupted upload, which yields the same ciphertext.
+			salt = st.Salt
+		} else {
+			salt = make([]byte, stream.SaltSize)
+			if _, err := rand.Read(salt); err != nil {
+				return err
+			}
+		}
+		if r, err = stream.NewEncrypter(r, s.key, salt); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Small enough for a single request.
+		if st != nil {
+			s.client.AbortMultipartUpload(obj, st.UploadID)
+		}
+		if err := s.client.Put(obj, buf[:n]); err != nil {
+			return err
+		}
+		return s.removeState(obj)
+	}
+	if err != nil {
+		return s.changed(st, err)
+	}
+	if st == nil {
+		st = &uploadState{Object: obj, Base: base, Salt: salt}
+	}
+	return s.upload(st, v, buf, r)
+}
+
+// upload performs a multipart upload of buf followed by the rest of r, skipping parts which were already
+// uploaded by the interrupted attempt st. v is the verifier of the data encrypted into r.
+func (s *S3) upload(st *uploadState, v *verifier, buf []byte, r io.Reader) error {
+	obj := st.Object
+	done := make(map[int]string)
+	if st.UploadID != "" {
+		parts, err := s.client.ListParts(obj, st.UploadID)
+		if s3.IsNotFound(err) {
+			st.UploadID = ""
+		} else if err != nil {
+			return err
+		}
+		for _, p := range parts {
+			done[p.Number] = p.ETag
+		}
+	}
+	if st.UploadID == "" {
+		id, err := s.client.CreateMultipartUpload(obj)
+		if err != nil {
+			return err
+		}
+		st.UploadID = id
+		if err := s.saveState(st); err != nil {
+			return err
+		}
+	} else {
+		s.exec.Printf("Resuming upload of %s\n", obj)
+	}
+
+	parts := []s3.Part{}
+	chunk := buf
+	for n := 1; ; n++ {
+		sum := md5.Sum(chunk)
+		etag := fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:]))
+		if done[n] != etag {
+			// Record the data the part is derived from before it leaves the host.
+			if len(v.sums) > len(st.Digests) {
+				st.Digests = append([]checkpoint(nil), v.sums...)
+				if err := s.saveState(st); err != nil {
+					return err
+				}
+			}
+			var err error
+			if etag, err = s.client.UploadPart(obj, st.UploadID, n, chunk); err != nil {
+				return fmt.Errorf("part %d: %v", n, err)
+			}
+		}
+		parts = append(parts, s3.Part{Number: n, ETag: etag})
+
+		l, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			// Keep the upload around unless the data changed: the next run resumes it.
+			return s.changed(st, err)
+		}
+		chunk = buf[:l]
+	}
+
+	if err := s.client.CompleteMultipartUpload(obj, st.UploadID, parts); err != nil {
+		return err
+	}
+	return s.removeState(obj)
+}
+
+// changed discards the interrupted upload st if err reports that the data differs from it, so that the next
+// run starts over. Other errors are returned as is.
+func (s *S3) changed(st *uploadState, err error) error {
+	if err != errChanged || st == nil {
+		return err
+	}
+	if err := s.discard(st); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s: %v, discarded it", st.Object, errChanged)
+}
+
+// discard aborts the interrupted upload st and removes its state.
+func (s *S3) discard(st *uploadState) error {
+	if st.UploadID != "" {
+		if err := s.client.AbortMultipartUpload(st.Object, st.UploadID); err != nil && !s3.IsNotFound(err) {
+			return err
+		}
+	}
+	return s.removeState(st.Object)
+}
+
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	obj := s.object(name)
+	rc, err := s.client.Get(obj)
+	if s3.IsNotFound(err) {
+		return nil, &os.PathError{Op: "get", Path: obj, Err: os.ErrNotExist}
+	}
+	if err != nil || s.key == nil {
+		return rc, err
+	}
+
+	dec, err := stream.NewDecrypter(rc, s.key)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("%s: %v", obj, err)
+	}
+	return readCloser{Reader: dec, Closer: rc}, nil
+}
+
+func (s *S3) Remove(name string) error {
+	return s.client.Delete(s.object(name))
+}
+
+func (s *S3) String() string {
+	return fmt.Sprintf("%s/%s", s.client, s.prefix)
+}
+
+// object returns the object name of name.
+func (s *S3) object(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+// statePath returns the path of the state file of obj.
+func (s *S3) statePath(obj string) string {
+	h := sha256.Sum256([]byte(s.client.String() + "/" + obj))
+	return filepath.Join(s.stateDir, hex.EncodeToString(h[:])+".json")
+}
+
+// loadState returns the state of an interrupted upload of obj, nil if there is none.
+func (s *S3) loadState(obj string) (*uploadState, error) {
+	pl, err := ioutil.ReadFile(s.statePath(obj))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := &uploadState{}
+	if err := json.Unmarshal(pl, st); err != nil || st.Object != obj {
+		// Unusable: start over.
+		return nil, nil
+	}
+	return st, nil
+}
+
+func (s *S3) saveState(st *uploadState) error {
+	if err := os.MkdirAll(s.stateDir, 0700); err != nil {
+		return err
+	}
+	pl, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.statePath(st.Object), pl, 0600)
+}
+
+func (s *S3) removeState(obj string) error {
+	if err := os.Remove(s.statePath(obj)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,267 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/s3"
+)
+
+// fakeS3 implements just enough of the S3 API to exercise the S3 store.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	puts    int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key := r.URL.Path
+	q := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	etag := func(b []byte) string {
+		s := md5.Sum(b)
+		return fmt.Sprintf("\"%s\"", hex.EncodeToString(s[:]))
+	}
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>gone</Message></Error>")
+	}
+
+	_, isCreate := q["uploads"]
+	id := q.Get("uploadId")
+	switch {
+	case r.Method == "POST" && isCreate:
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && id != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.uploads[id][n] = body
+		f.puts++
+		w.Header().Set("ETag", etag(body))
+	case r.Method == "GET" && id != "":
+		up, ok := f.uploads[id]
+		if !ok {
+			notFound()
+			return
+		}
+		fmt.Fprint(w, "<ListPartsResult>")
+		for n, b := range up {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", n, etag(b))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case r.Method == "POST" && id != "":
+		req := struct {
+			Parts []s3.Part `xml:"Part"`
+		}{}
+		xml.Unmarshal(body, &req)
+		sort.Slice(req.Parts, func(i, j int) bool { return req.Parts[i].Number < req.Parts[j].Number })
+		obj := []byte{}
+		for _, p := range req.Parts {
+			obj = append(obj, f.uploads[id][p.Number]...)
+		}
+		f.objects[key] = obj
+		delete(f.uploads, id)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && id != "":
+		delete(f.uploads, id)
+	case r.Method == "PUT":
+		f.objects[key] = body
+		f.puts++
+	case r.Method == "GET":
+		b, ok := f.objects[key]
+		if !ok {
+			notFound()
+			return
+		}
+		w.Write(b)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+	}
+}
+
+// failingReader returns an error after n bytes.
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, fmt.Errorf("connection reset")
+	}
+	if len(b) > f.n {
+		b = b[:f.n]
+	}
+	n, err := f.r.Read(b)
+	f.n -= n
+	return n, err
+}
+
+func TestS3Resume(t *testing.T) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "s3state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := s3.New(srv.URL, "", "bucket", "ak", "sk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &S3{
+		client:   c,
+		prefix:   "tank",
+		partSize: 64 * 1024,
+		key:      bytes.Repeat([]byte{1}, 32),
+		stateDir: dir,
+		exec:     &exec.Exec{},
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	if err := s.Put("stream", &failingReader{r: bytes.NewReader(data), n: 200000}); err == nil {
+		t.Fatalf("Put() of interrupted stream = nil, wanted err")
+	}
+	if _, err := s.Get("stream"); !os.IsNotExist(err) {
+		t.Errorf("Get() of interrupted stream = _, %v, want not exist", err)
+	}
+	interrupted := fake.puts
+
+	if err := s.Put("stream", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Put() = %v, want nil", err)
+	}
+	// 320000 bytes of data and some overhead make 5 parts, 3 of which were already uploaded.
+	if got := fake.puts - interrupted; got != 2 {
+		t.Errorf("resumed upload sent %d parts, want 2", got)
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d uploads were left behind", len(fake.uploads))
+	}
+
+	rc, err := s.Get("stream")
+	if err != nil {
+		t.Fatalf("Get() = _, %v, want nil", err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get() returned %d bytes, %v, want %d bytes", len(got), err, len(data))
+	}
+	if bytes.Contains(fake.objects["/bucket/tank/stream"], data[:64]) {
+		t.Errorf("object was stored unencrypted")
+	}
+
+	// Small objects, such as the manifest, use a single request.
+	m := &Manifest{Kind: "zfs", Entries: []*Entry{{Name: "daily@1997-01-17T16:54:13Z"}}}
+	if err := m.Save(s); err != nil {
+		t.Fatalf("Save() = %v, want nil", err)
+	}
+	lm, err := LoadManifest(s)
+	if err != nil || lm.Find("daily@1997-01-17T16:54:13Z") == nil {
+		t.Errorf("LoadManifest() = %+v, %v, want saved manifest", lm, err)
+	}
+	if err := s.Remove(ManifestName); err != nil {
+		t.Errorf("Remove() = %v, want nil", err)
+	}
+	if lm, err := LoadManifest(s); err != nil || len(lm.Entries) != 0 {
+		t.Errorf("LoadManifest() after Remove() = %+v, %v, want empty manifest", lm, err)
+	}
+}
+
+func TestS3ResumeChanged(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	changed := append([]byte(nil), data...)
+	changed[150000] = 'x'
+	tests := []struct {
+		desc string
+		base string
+		data []byte
+		// wantErr is set if the change is only detected while reading the stream.
+		wantErr bool
+	}{
+		{"same stream", "daily-a", data, false},
+		{"other base", "daily-b", data, false},
+		{"data of uploaded parts changed", "daily-a", changed, true},
+		{"shorter", "daily-a", data[:100000], true},
+	}
+	for _, tt := range tests {
+		fake := newFakeS3()
+		srv := httptest.NewServer(fake)
+		dir, err := ioutil.TempDir("", "s3state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := s3.New(srv.URL, "", "bucket", "ak", "sk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &S3{client: c, prefix: "tank", partSize: 64 * 1024, key: bytes.Repeat([]byte{1}, 32), stateDir: dir, exec: &exec.Exec{}}
+
+		if err := s.PutStream("stream", "daily-a", &failingReader{r: bytes.NewReader(data), n: 200000}); err == nil {
+			t.Fatalf("%s: PutStream() of interrupted stream = nil, wanted err", tt.desc)
+		}
+		first := append([]byte(nil), fake.uploads["1"][1][:64]...)
+
+		err = s.PutStream("stream", tt.base, bytes.NewReader(tt.data))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: PutStream() = nil, wanted err", tt.desc)
+			}
+			// The next attempt starts over.
+			err = s.PutStream("stream", tt.base, bytes.NewReader(tt.data))
+		}
+		if err != nil {
+			t.Errorf("%s: PutStream() = %v, want nil", tt.desc, err)
+		}
+		if len(fake.uploads) != 0 {
+			t.Errorf("%s: %d uploads were left behind", tt.desc, len(fake.uploads))
+		}
+		// Only the same stream may be encrypted using the salt of the interrupted upload.
+		obj := fake.objects["/bucket/tank/stream"]
+		if same := bytes.HasPrefix(obj, first); same != (tt.desc == "same stream") {
+			t.Errorf("%s: stream starts like the interrupted upload: %v", tt.desc, same)
+		}
+		rc, err := s.Get("stream")
+		if err != nil {
+			t.Errorf("%s: Get() = _, %v, want nil", tt.desc, err)
+		} else {
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(got, tt.data) {
+				t.Errorf("%s: Get() returned %d bytes, %v, want %d bytes", tt.desc, len(got), err, len(tt.data))
+			}
+		}
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
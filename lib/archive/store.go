@@ -0,0 +1,96 @@
+package archive
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/opts"
+)
+
+// Store persists archived streams.
+type Store interface {
+	// Put stores the content of r as name. Nothing is stored if reading r fails.
+	Put(name string, r io.Reader) error
+	// Get opens a stored object, returning an error matching os.IsNotExist if it does not exist.
+	Get(name string) (io.ReadCloser, error)
+	// Remove deletes a stored object.
+	Remove(name string) error
+	// String returns a human readable description of the store.
+	String() string
+}
+
+// StreamStore is implemented by stores which resume interrupted uploads of streams.
+type StreamStore interface {
+	// PutStream stores the stream r as name like Put. base is the name of the base snapshot of an
+	// incremental stream, which is not part of name.
+	PutStream(name, base string, r io.Reader) error
+}
+
+// Open returns the store configured in ao.
+func Open(ao *opts.Archive, e *exec.Exec) (Store, error) {
+	switch {
+	case ao.Dir != "" && ao.S3 != nil:
+		return nil, fmt.Errorf("archive must not define both 'dir' and 's3'")
+	case ao.S3 != nil:
+		return NewS3(ao.S3, e)
+	case ao.Dir != "":
+		return NewDir(ao.Dir)
+	}
+	return nil, fmt.Errorf("archive needs either 'dir' or 's3'")
+}
+
+// Dir stores streams as files within a local directory.
+type Dir struct {
+	path string
+}
+
+func NewDir(path string) (*Dir, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrInvalid}
+	}
+	return &Dir{path: path}, nil
+}
+
+func (d *Dir) Put(name string, r io.Reader) error {
+	dst := filepath.Join(d.path, name)
+	tmp := dst + ".partial"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, r); err != nil {
+		fh.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// Removable disks are unplugged without warning: make sure the data reached the disk.
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (d *Dir) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.path, name))
+}
+
+func (d *Dir) Remove(name string) error {
+	return os.Remove(filepath.Join(d.path, name))
+}
+
+func (d *Dir) String() string {
+	return d.path
+}
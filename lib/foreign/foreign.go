@@ -0,0 +1,140 @@
+// Package foreign recognizes snapshots created by other tools, so that minisnap can adopt them.
+package foreign
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// Parser recognizes the snapshot names of another tool.
+type Parser interface {
+	// Tool returns the name of the tool, as used in the 'adopt' option.
+	Tool() string
+	// Parse converts the snapshot name into a snap object, false if the tool did not create it.
+	Parse(name string) (*snapobj.SnapObj, bool)
+}
+
+// Snapper is the name of snapper in the 'adopt' option. It is only supported on btrfs, as its snapshots are
+// described by info.xml files instead of their names. See ParseSnapperInfo.
+const Snapper = "snapper"
+
+// pattern parses names holding a timestamp and a snapshot type.
+type pattern struct {
+	tool string
+	// re must have the named groups 'time' and 'type'.
+	re     *regexp.Regexp
+	layout string
+	types  map[string]snapobj.Type
+	loc    *time.Location
+}
+
+func (p *pattern) Tool() string {
+	return p.tool
+}
+
+func (p *pattern) Parse(name string) (*snapobj.SnapObj, bool) {
+	m := p.re.FindStringSubmatch(name)
+	if m == nil {
+		return nil, false
+	}
+	var ts, tn string
+	for i, g := range p.re.SubexpNames() {
+		switch g {
+		case "time":
+			ts = m[i]
+		case "type":
+			tn = m[i]
+		}
+	}
+	t, ok := p.types[tn]
+	if !ok {
+		return nil, false
+	}
+	epoch, err := time.ParseInLocation(p.layout, ts, p.loc)
+	if err != nil {
+		return nil, false
+	}
+	return &snapobj.SnapObj{Type: t, Epoch: epoch.UTC(), Source: name}, true
+}
+
+// zfsTools returns the parsers of the supported ZFS snapshot tools, keyed by their name.
+func zfsTools(loc *time.Location) map[string]Parser {
+	return map[string]Parser{
+		// zfs-auto-snap_hourly-2020-05-17-1400, frequent snapshots are taken every 15 minutes.
+		"zfs-auto-snapshot": &pattern{
+			tool:   "zfs-auto-snapshot",
+			re:     regexp.MustCompile(`^zfs-auto-snap_(?P<type>[a-z]+)-(?P<time>\d{4}-\d{2}-\d{2}-\d{4})$`),
+			layout: "2006-01-02-1504",
+			types: map[string]snapobj.Type{"frequent": snapobj.Minutely, "hourly": snapobj.Hourly, "daily": snapobj.Daily,
+				"weekly": snapobj.Weekly, "monthly": snapobj.Monthly, "yearly": snapobj.Yearly},
+			loc: loc,
+		},
+		// autosnap_2020-05-17_14:00:01_hourly
+		"sanoid": &pattern{
+			tool:   "sanoid",
+			re:     regexp.MustCompile(`^autosnap_(?P<time>\d{4}-\d{2}-\d{2}_\d{2}:\d{2}:\d{2})_(?P<type>[a-z]+)$`),
+			layout: "2006-01-02_15:04:05",
+			types: map[string]snapobj.Type{"frequently": snapobj.Minutely, "hourly": snapobj.Hourly, "daily": snapobj.Daily,
+				"weekly": snapobj.Weekly, "monthly": snapobj.Monthly, "yearly": snapobj.Yearly},
+			loc: loc,
+		},
+	}
+}
+
+// ForZFS returns the parsers of the given ZFS snapshot tools.
+// Both zfs-auto-snapshot and sanoid name their snapshots using the local time, which is given as loc.
+func ForZFS(tools []string, loc *time.Location) ([]Parser, error) {
+	known := zfsTools(loc)
+	var r []Parser
+	for _, t := range tools {
+		p, ok := known[t]
+		if !ok {
+			return nil, fmt.Errorf("can not adopt snapshots of '%s' on ZFS", t)
+		}
+		r = append(r, p)
+	}
+	return r, nil
+}
+
+// snapperInfo is the part of a snapper info.xml file we care about.
+type snapperInfo struct {
+	Type        string `xml:"type"`
+	Num         int    `xml:"num"`
+	Date        string `xml:"date"`
+	Description string `xml:"description"`
+	Cleanup     string `xml:"cleanup"`
+}
+
+// ParseSnapperInfo converts the info.xml file of snapper snapshot number num, whose subvolume is at source.
+// Timeline snapshots become hourly snapshots. All others, such as the pre and post snapshots of package
+// managers, become manual snapshots labeled 'snapper-<type>', which never expire.
+func ParseSnapperInfo(num int, source string, data []byte) (*snapobj.SnapObj, error) {
+	var si snapperInfo
+	if err := xml.Unmarshal(data, &si); err != nil {
+		return nil, err
+	}
+	if si.Num != num {
+		return nil, fmt.Errorf("info of snapshot %d refers to snapshot %d", num, si.Num)
+	}
+	// Snapper stores the date in UTC.
+	epoch, err := time.Parse("2006-01-02 15:04:05", si.Date)
+	if err != nil {
+		return nil, err
+	}
+	so := &snapobj.SnapObj{Type: snapobj.Hourly, Epoch: epoch, Source: source}
+	if si.Cleanup != "timeline" {
+		so.Type = snapobj.Manual
+		so.Label = "snapper-" + si.Type
+		if err := snapobj.ValidLabel(so.Label); err != nil {
+			return nil, err
+		}
+	}
+	if si.Description != "" && si.Description != "timeline" && snapobj.ValidMeta(si.Description) == nil {
+		so.Meta = map[string]string{snapobj.MetaNote: si.Description}
+	}
+	return so, nil
+}
@@ -0,0 +1,162 @@
+package foreign
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	cet := time.FixedZone("CET", 3600)
+	tests := []struct {
+		desc string
+		tool string
+		name string
+		want *snapobj.SnapObj
+	}{
+		{
+			desc: "zfs-auto-snapshot",
+			tool: "zfs-auto-snapshot",
+			name: "zfs-auto-snap_hourly-1997-01-17-1754",
+			want: &snapobj.SnapObj{Type: snapobj.Hourly, Epoch: time.Unix(853520040, 0).UTC(), Source: "zfs-auto-snap_hourly-1997-01-17-1754"},
+		},
+		{
+			desc: "zfs-auto-snapshot frequent",
+			tool: "zfs-auto-snapshot",
+			name: "zfs-auto-snap_frequent-1997-01-17-1754",
+			want: &snapobj.SnapObj{Type: snapobj.Minutely, Epoch: time.Unix(853520040, 0).UTC(), Source: "zfs-auto-snap_frequent-1997-01-17-1754"},
+		},
+		{
+			desc: "zfs-auto-snapshot custom label",
+			tool: "zfs-auto-snapshot",
+			name: "zfs-auto-snap_backup-1997-01-17-1754",
+		},
+		{
+			desc: "sanoid",
+			tool: "sanoid",
+			name: "autosnap_1997-01-17_17:54:13_daily",
+			want: &snapobj.SnapObj{Type: snapobj.Daily, Epoch: time.Unix(853520053, 0).UTC(), Source: "autosnap_1997-01-17_17:54:13_daily"},
+		},
+		{
+			desc: "sanoid frequently",
+			tool: "sanoid",
+			name: "autosnap_1997-01-17_17:54:13_frequently",
+			want: &snapobj.SnapObj{Type: snapobj.Minutely, Epoch: time.Unix(853520053, 0).UTC(), Source: "autosnap_1997-01-17_17:54:13_frequently"},
+		},
+		{
+			desc: "sanoid invalid time",
+			tool: "sanoid",
+			name: "autosnap_1997-13-17_17:54:13_daily",
+		},
+		{
+			desc: "other tool",
+			tool: "sanoid",
+			name: "zfs-auto-snap_hourly-1997-01-17-1754",
+		},
+		{
+			desc: "our own",
+			tool: "zfs-auto-snapshot",
+			name: "msnap_daily::1997-01-17T16:54:13Z",
+		},
+	}
+	for _, tc := range tests {
+		p, err := ForZFS([]string{tc.tool}, cet)
+		if err != nil {
+			t.Fatalf("%s: ForZFS() = _, %v, want nil", tc.desc, err)
+		}
+		got, ok := p[0].Parse(tc.name)
+		if ok != (tc.want != nil) {
+			t.Errorf("%s: Parse(%s) = _, %v, want %v", tc.desc, tc.name, ok, tc.want != nil)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: Parse(%s) mismatch (-want +got)\n%s", tc.desc, tc.name, diff)
+		}
+	}
+}
+
+func TestForZFS(t *testing.T) {
+	p, err := ForZFS([]string{"sanoid", "zfs-auto-snapshot"}, time.UTC)
+	if err != nil {
+		t.Fatalf("ForZFS() = _, %v, want nil", err)
+	}
+	var got []string
+	for _, x := range p {
+		got = append(got, x.Tool())
+	}
+	if diff := cmp.Diff([]string{"sanoid", "zfs-auto-snapshot"}, got); diff != "" {
+		t.Errorf("ForZFS() mismatch (-want +got)\n%s", diff)
+	}
+	for _, tool := range []string{Snapper, "zrepl"} {
+		if _, err := ForZFS([]string{tool}, time.UTC); err == nil {
+			t.Errorf("ForZFS(%s) = _, nil, want error", tool)
+		}
+	}
+}
+
+func TestParseSnapperInfo(t *testing.T) {
+	tests := []struct {
+		desc    string
+		num     int
+		info    string
+		want    *snapobj.SnapObj
+		wantErr bool
+	}{
+		{
+			desc: "timeline",
+			num:  1,
+			info: "<snapshot><type>single</type><num>1</num><date>1997-01-17 16:54:13</date>" +
+				"<description>timeline</description><cleanup>timeline</cleanup></snapshot>",
+			want: &snapobj.SnapObj{Type: snapobj.Hourly, Epoch: time.Unix(853520053, 0).UTC(), Source: "1/snapshot"},
+		},
+		{
+			desc: "post",
+			num:  3,
+			info: "<snapshot><type>post</type><num>3</num><date>1997-01-17 16:54:13</date><pre_num>2</pre_num>" +
+				"<description>zypp(zypper)</description><cleanup>number</cleanup></snapshot>",
+			want: &snapobj.SnapObj{
+				Type:   snapobj.Manual,
+				Epoch:  time.Unix(853520053, 0).UTC(),
+				Label:  "snapper-post",
+				Meta:   map[string]string{snapobj.MetaNote: "zypp(zypper)"},
+				Source: "3/snapshot",
+			},
+		},
+		{
+			desc: "single without description",
+			num:  4,
+			info: "<snapshot><type>single</type><num>4</num><date>1997-01-17 16:54:13</date></snapshot>",
+			want: &snapobj.SnapObj{Type: snapobj.Manual, Epoch: time.Unix(853520053, 0).UTC(), Label: "snapper-single", Source: "4/snapshot"},
+		},
+		{
+			desc:    "wrong number",
+			num:     5,
+			info:    "<snapshot><type>single</type><num>4</num><date>1997-01-17 16:54:13</date></snapshot>",
+			wantErr: true,
+		},
+		{
+			desc:    "invalid date",
+			num:     1,
+			info:    "<snapshot><type>single</type><num>1</num><date>yesterday</date></snapshot>",
+			wantErr: true,
+		},
+		{
+			desc:    "not xml",
+			num:     1,
+			info:    "snapshot",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		got, err := ParseSnapperInfo(tc.num, fmt.Sprintf("%d/snapshot", tc.num), []byte(tc.info))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: ParseSnapperInfo() = _, %v, want error %v", tc.desc, err, tc.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: ParseSnapperInfo() mismatch (-want +got)\n%s", tc.desc, diff)
+		}
+	}
+}
@@ -1,25 +1,39 @@
 package btrfs
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/adrian-bl/minisnap/lib/foreign"
+	fsexec "github.com/adrian-bl/minisnap/lib/fs/exec"
 	"github.com/adrian-bl/minisnap/lib/snapobj"
 )
 
 type exec interface {
 	Execute(name string, args ...string) error
+	WriteFile(path string, data []byte) error
+	Remove(path string) error
 }
 
 type Btrfs struct {
-	path    string
-	snapdir string
+	path     string
+	snapdir  string
+	readonly bool
+	// tmpl names our snapshots, FileName is used if nil.
+	tmpl *snapobj.Template
+	// snapper adopts the numbered snapshots of snapper, which shares the snapshot directory with us.
+	snapper bool
 	exec    exec
 }
 
-func New(path, snapdir string, exec exec) *Btrfs {
-	return &Btrfs{path: path, snapdir: snapdir, exec: exec}
+func New(path, snapdir string, exec exec, readonly bool, tmpl *snapobj.Template, snapper bool) *Btrfs {
+	return &Btrfs{path: path, snapdir: snapdir, readonly: readonly, tmpl: tmpl, snapper: snapper, exec: exec}
 }
 
 func (b *Btrfs) wdir() string {
@@ -52,19 +66,251 @@ func (b *Btrfs) Gather() ([]*snapobj.SnapObj, error) {
 			return nil, err
 		}
 		for _, e := range fi {
-			so, err := snapobj.FromFileInfo(e)
+			if !e.IsDir() {
+				continue
+			}
+			so, err := parseName(b.tmpl, e.Name())
+			if err != nil && b.snapper {
+				so, err = b.snapperInfo(e.Name())
+			}
 			if err == nil {
 				g = append(g, so)
 			}
 		}
 	}
+	// Unreadable sidecar files only lose the metadata, they must not keep snapshots from being managed.
+	for _, so := range g {
+		m, err := b.readMeta(so)
+		if err != nil || len(m) == 0 {
+			continue
+		}
+		if so.Meta == nil {
+			so.Meta = make(map[string]string)
+		}
+		for k, v := range m {
+			so.Meta[k] = v
+		}
+	}
 	return g, nil
 }
 
+// parseName converts the snapshot name n. With a template, names in the legacy format are returned as
+// adopted snapshots, so they get migrated.
+func parseName(tmpl *snapobj.Template, n string) (*snapobj.SnapObj, error) {
+	if so, err := tmpl.Parse(n); err == nil || tmpl == nil {
+		return so, err
+	}
+	so, err := snapobj.FromString(n)
+	if err != nil {
+		return nil, err
+	}
+	so.Source = n
+	return so, nil
+}
+
+// Naming returns the template of the snapshot names, nil for the legacy format.
+func (b *Btrfs) Naming() *snapobj.Template {
+	return b.tmpl
+}
+
+// snapperInfo returns the snapper snapshot in the numbered directory n of the snapshot directory.
+func (b *Btrfs) snapperInfo(n string) (*snapobj.SnapObj, error) {
+	num, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/info.xml", b.wdir(), n))
+	if err != nil {
+		return nil, err
+	}
+	return foreign.ParseSnapperInfo(num, n+"/snapshot", pl)
+}
+
+// snapPath returns the path of the subvolume of s.
+func (b *Btrfs) snapPath(s *snapobj.SnapObj) string {
+	if s.Adopted() {
+		return fmt.Sprintf("%s/%s", b.wdir(), s.Source)
+	}
+	return fmt.Sprintf("%s/%s", b.wdir(), b.tmpl.Format(s))
+}
+
+// snapperSource returns true if s is a snapper snapshot, whose subvolume lives in a numbered directory.
+func snapperSource(s *snapobj.SnapObj) bool {
+	return strings.Contains(s.Source, "/")
+}
+
 func (b *Btrfs) Create(s *snapobj.SnapObj) error {
-	return b.exec.Execute("btrfs", "subvol", "snapshot", b.path, fmt.Sprintf("%s/%s", b.wdir(), s.FileName()))
+	args := []string{"subvol", "snapshot"}
+	if b.readonly {
+		args = append(args, "-r")
+	}
+	args = append(args, b.path, b.snapPath(s))
+	if err := b.exec.Execute("btrfs", args...); err != nil {
+		return err
+	}
+	if len(s.Meta) == 0 {
+		return nil
+	}
+	return b.Annotate(s, s.Meta)
 }
 
 func (b *Btrfs) Delete(s *snapobj.SnapObj) error {
-	return b.exec.Execute("btrfs", "subvol", "delete", fmt.Sprintf("%s/%s", b.wdir(), s.FileName()))
+	if err := b.exec.Execute("btrfs", "subvol", "delete", b.snapPath(s)); err != nil {
+		return err
+	}
+	if err := b.removeSnapper(s); err != nil {
+		return err
+	}
+	return b.exec.Remove(b.sidecar(s))
+}
+
+// Rename gives the adopted snapshot s our own name.
+// The metadata of snapper snapshots is moved from their info.xml file into our sidecar file.
+func (b *Btrfs) Rename(s *snapobj.SnapObj) error {
+	native := *s
+	native.Source = ""
+	if err := b.exec.Execute("mv", "-T", b.snapPath(s), b.snapPath(&native)); err != nil {
+		return err
+	}
+	if !snapperSource(s) {
+		if _, err := os.Stat(b.sidecar(s)); os.IsNotExist(err) {
+			return nil
+		}
+		return b.exec.Execute("mv", "-T", b.sidecar(s), b.sidecar(&native))
+	}
+	if len(s.Meta) > 0 {
+		if err := b.Annotate(&native, s.Meta); err != nil {
+			return err
+		}
+	}
+	return b.removeSnapper(s)
+}
+
+// removeSnapper removes the info.xml file and the numbered directory left behind by the snapper snapshot s,
+// once its subvolume is gone. Directories holding other files are reported as an error.
+func (b *Btrfs) removeSnapper(s *snapobj.SnapObj) error {
+	if !snapperSource(s) {
+		return nil
+	}
+	dir := filepath.Dir(b.snapPath(s))
+	if err := b.exec.Remove(dir + "/info.xml"); err != nil {
+		return err
+	}
+	return b.exec.Remove(dir)
+}
+
+// sidecar returns the path of the file holding the metadata of s.
+// It lives next to the snapshot, as read-only snapshots can not be changed. Snapper snapshots use the
+// sidecar of the name they are migrated to, as they keep their own metadata in their directory.
+func (b *Btrfs) sidecar(s *snapobj.SnapObj) string {
+	if s.Adopted() && !snapperSource(s) {
+		return fmt.Sprintf("%s/%s.json", b.wdir(), s.Source)
+	}
+	return fmt.Sprintf("%s/%s.json", b.wdir(), b.tmpl.Format(s))
+}
+
+// Annotate stores meta in the JSON encoded sidecar file of the snapshot.
+func (b *Btrfs) Annotate(s *snapobj.SnapObj, meta map[string]string) error {
+	m, err := b.readMeta(s)
+	if err != nil {
+		return err
+	}
+	for k, v := range meta {
+		m[k] = v
+	}
+	pl, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.exec.WriteFile(b.sidecar(s), append(pl, '\n'))
+}
+
+// readMeta returns the metadata in the sidecar file of s, which is empty if there is none.
+func (b *Btrfs) readMeta(s *snapobj.SnapObj) (map[string]string, error) {
+	m := make(map[string]string)
+	pl, err := ioutil.ReadFile(b.sidecar(s))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(pl, &m); err != nil {
+		return nil, fmt.Errorf("invalid metadata in %s: %v", b.sidecar(s), err)
+	}
+	return m, nil
+}
+
+// Kind returns the stream format produced by Send.
+func (b *Btrfs) Kind() string {
+	return "btrfs"
+}
+
+// Send returns the command writing s to stdout, incremental to base if non-nil.
+func (b *Btrfs) Send(base, s *snapobj.SnapObj) fsexec.Cmd {
+	args := []string{"send", "-q"}
+	if base != nil {
+		args = append(args, "-p", b.snapPath(base))
+	}
+	args = append(args, b.snapPath(s))
+	return fsexec.Cmd{Name: "btrfs", Args: args}
+}
+
+// Estimate returns the command printing the size of the snapshot sent by send.
+// Btrfs has no way to predict the size of incremental streams.
+func (b *Btrfs) Estimate(send fsexec.Cmd) (fsexec.Cmd, bool) {
+	if send.Name != "btrfs" || len(send.Args) == 0 || send.Args[0] != "send" {
+		return fsexec.Cmd{}, false
+	}
+	for _, a := range send.Args {
+		if a == "-p" {
+			return fsexec.Cmd{}, false
+		}
+	}
+	return fsexec.Cmd{Name: "btrfs", Args: []string{"filesystem", "du", "-s", "--raw", send.Args[len(send.Args)-1]}}, true
+}
+
+// ParseEstimate returns the total size reported by 'btrfs filesystem du'.
+func (b *Btrfs) ParseEstimate(out []byte) (int64, error) {
+	l := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(l) != 2 {
+		return 0, fmt.Errorf("unexpected output of btrfs filesystem du")
+	}
+	f := strings.Fields(l[1])
+	if len(f) == 0 {
+		return 0, fmt.Errorf("unexpected output of btrfs filesystem du")
+	}
+	return strconv.ParseInt(f[0], 10, 64)
+}
+
+// Receiver consumes streams produced by 'btrfs send'.
+type Receiver struct {
+	// Naming is the template of the snapshot names, nil for the legacy format.
+	Naming *snapobj.Template
+}
+
+// Receive returns the command reading a stream from stdin into the directory dest.
+func (r Receiver) Receive(dest string) fsexec.Cmd {
+	return fsexec.Cmd{Name: "btrfs", Args: []string{"receive", dest}}
+}
+
+// List returns the command listing all entries of dest.
+func (r Receiver) List(dest string) fsexec.Cmd {
+	return fsexec.Cmd{Name: "ls", Args: []string{"-1", dest}}
+}
+
+// Parse converts the output of List into snapshot objects, ignoring unknown entries.
+func (r Receiver) Parse(dest string, out []byte) ([]*snapobj.SnapObj, error) {
+	g := make([]*snapobj.SnapObj, 0)
+	for _, l := range strings.Split(string(out), "\n") {
+		if so, err := parseName(r.Naming, l); err == nil {
+			g = append(g, so)
+		}
+	}
+	return g, nil
+}
+
+// Missing returns true if stderr says that dest does not exist.
+func (r Receiver) Missing(stderr []byte) bool {
+	return strings.Contains(string(stderr), "No such file or directory")
 }
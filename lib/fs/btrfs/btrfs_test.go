@@ -0,0 +1,200 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	fsexec "github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeExec creates directories instead of running btrfs, and writes files for real.
+type fakeExec struct {
+	fsexec.Exec
+}
+
+func (f *fakeExec) Execute(name string, args ...string) error {
+	if name == "mv" {
+		return os.Rename(args[len(args)-2], args[len(args)-1])
+	}
+	if len(args) > 1 && args[1] == "snapshot" {
+		return os.Mkdir(args[len(args)-1], 0755)
+	}
+	return os.RemoveAll(args[len(args)-1])
+}
+
+func TestMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, ".snapshots"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(dir, ".snapshots", &fakeExec{}, true, nil, false)
+	with := &snapobj.SnapObj{
+		Type:  snapobj.Daily,
+		Epoch: time.Unix(853520053, 0).UTC(),
+		Meta:  map[string]string{snapobj.MetaCreator: "root"},
+	}
+	without := &snapobj.SnapObj{Type: snapobj.Hourly, Epoch: time.Unix(853520053, 0).UTC()}
+	for _, so := range []*snapobj.SnapObj{with, without} {
+		if err := b.Create(so); err != nil {
+			t.Fatalf("Create(%s) = %v, want nil", so.FileName(), err)
+		}
+	}
+	if err := b.Annotate(with, map[string]string{snapobj.MetaNote: "a note"}); err != nil {
+		t.Fatalf("Annotate() = %v, want nil", err)
+	}
+
+	got, err := b.Gather()
+	if err != nil {
+		t.Fatalf("Gather() = _, %v, want nil", err)
+	}
+	want := map[string]map[string]string{
+		with.FileName():    {snapobj.MetaCreator: "root", snapobj.MetaNote: "a note"},
+		without.FileName(): nil,
+	}
+	gotMeta := make(map[string]map[string]string)
+	for _, so := range got {
+		gotMeta[so.FileName()] = so.Meta
+	}
+	if diff := cmp.Diff(want, gotMeta); diff != "" {
+		t.Errorf("Gather() metadata mismatch (-want +got)\n%s", diff)
+	}
+
+	if err := b.Delete(with); err != nil {
+		t.Fatalf("Delete() = %v, want nil", err)
+	}
+	if _, err := os.Stat(b.sidecar(with)); !os.IsNotExist(err) {
+		t.Errorf("Delete() left the sidecar behind: %v", err)
+	}
+}
+
+func TestSnapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := map[string]string{
+		"1": "<?xml version=\"1.0\"?>\n<snapshot>\n  <type>single</type>\n  <num>1</num>\n" +
+			"  <date>1997-01-17 16:54:13</date>\n  <description>timeline</description>\n  <cleanup>timeline</cleanup>\n</snapshot>\n",
+		"2": "<?xml version=\"1.0\"?>\n<snapshot>\n  <type>pre</type>\n  <num>2</num>\n" +
+			"  <date>1997-01-18 16:54:13</date>\n  <description>zypp(zypper)</description>\n  <cleanup>number</cleanup>\n</snapshot>\n",
+	}
+	for n, x := range info {
+		if err := os.MkdirAll(filepath.Join(dir, ".snapshots", n, "snapshot"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, ".snapshots", n, "info.xml"), []byte(x), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := New(dir, ".snapshots", &fakeExec{}, true, nil, true)
+	got, err := b.Gather()
+	if err != nil {
+		t.Fatalf("Gather() = _, %v, want nil", err)
+	}
+	want := []*snapobj.SnapObj{
+		{Type: snapobj.Hourly, Epoch: time.Unix(853520053, 0).UTC(), Source: "1/snapshot"},
+		{
+			Type:   snapobj.Manual,
+			Epoch:  time.Unix(853606453, 0).UTC(),
+			Label:  "snapper-pre",
+			Meta:   map[string]string{snapobj.MetaNote: "zypp(zypper)"},
+			Source: "2/snapshot",
+		},
+	}
+	sortByEpoch(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Gather() mismatch (-want +got)\n%s", diff)
+	}
+
+	for _, so := range got {
+		if err := b.Rename(so); err != nil {
+			t.Fatalf("Rename(%s) = %v, want nil", so.Source, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".snapshots", "1")); !os.IsNotExist(err) {
+		t.Errorf("Rename() left the snapper directory behind: %v", err)
+	}
+	got, err = b.Gather()
+	if err != nil {
+		t.Fatalf("Gather() = _, %v, want nil", err)
+	}
+	for _, so := range want {
+		so.Source = ""
+	}
+	sortByEpoch(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Gather() after Rename() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, ".snapshots"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := snapobj.ParseTemplate("{type}-{2006-01-02_1504}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot taken before the template was set.
+	legacy := &snapobj.SnapObj{Type: snapobj.Daily, Epoch: time.Unix(853520040, 0).UTC(), Meta: map[string]string{snapobj.MetaNote: "old"}}
+	if err := New(dir, ".snapshots", &fakeExec{}, true, nil, false).Create(legacy); err != nil {
+		t.Fatalf("Create() = %v, want nil", err)
+	}
+	b := New(dir, ".snapshots", &fakeExec{}, true, tmpl, false)
+	manual := &snapobj.SnapObj{Type: snapobj.Manual, Epoch: time.Unix(853606440, 0).UTC(), Label: "pre-upgrade"}
+	if err := b.Create(manual); err != nil {
+		t.Fatalf("Create() = %v, want nil", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".snapshots", "manual-1997-01-18_1654_pre-upgrade_never")); err != nil {
+		t.Errorf("Create() did not use the template: %v", err)
+	}
+
+	got, err := b.Gather()
+	if err != nil {
+		t.Fatalf("Gather() = _, %v, want nil", err)
+	}
+	want := []*snapobj.SnapObj{
+		{Type: snapobj.Daily, Epoch: legacy.Epoch, Meta: legacy.Meta, Source: "daily@1997-01-17T16:54:00Z"},
+		manual,
+	}
+	sortByEpoch(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Gather() mismatch (-want +got)\n%s", diff)
+	}
+
+	if err := b.Rename(got[0]); err != nil {
+		t.Fatalf("Rename() = %v, want nil", err)
+	}
+	got, err = b.Gather()
+	if err != nil {
+		t.Fatalf("Gather() = _, %v, want nil", err)
+	}
+	want[0].Source = ""
+	sortByEpoch(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Gather() after Rename() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func sortByEpoch(s []*snapobj.SnapObj) {
+	sort.Slice(s, func(i, j int) bool { return s[i].Epoch.Before(s[j].Epoch) })
+}
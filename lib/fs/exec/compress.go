@@ -0,0 +1,23 @@
+package exec
+
+// Compressor describes the commands used to (de)compress a stream.
+type Compressor struct {
+	Compress   Cmd
+	Decompress Cmd
+	// Ext is the file extension used for compressed files.
+	Ext string
+}
+
+// Compressors maps the supported compression names to their commands.
+var Compressors = map[string]Compressor{
+	"zstd": {
+		Compress:   Cmd{Name: "zstd", Args: []string{"-q", "-c"}},
+		Decompress: Cmd{Name: "zstd", Args: []string{"-q", "-d", "-c"}},
+		Ext:        ".zst",
+	},
+	"lz4": {
+		Compress:   Cmd{Name: "lz4", Args: []string{"-q", "-c"}},
+		Decompress: Cmd{Name: "lz4", Args: []string{"-q", "-d", "-c"}},
+		Ext:        ".lz4",
+	},
+}
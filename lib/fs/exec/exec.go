@@ -1,9 +1,13 @@
 package exec
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 type Exec struct {
@@ -11,19 +15,305 @@ type Exec struct {
 	DryRun bool
 	// Print command which was executed.
 	Verbose bool
+	// Stdout and Stderr receive messages and the output of executed commands.
+	// They default to os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Printf prints a message to the standard output of e.
+func (e *Exec) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(e.stdout(), format, args...)
+}
+
+// Eprintf prints a message to the standard error of e.
+func (e *Exec) Eprintf(format string, args ...interface{}) {
+	fmt.Fprintf(e.stderr(), format, args...)
+}
+
+func (e *Exec) stdout() io.Writer {
+	if e.Stdout == nil {
+		return os.Stdout
+	}
+	return e.Stdout
+}
+
+func (e *Exec) stderr() io.Writer {
+	if e.Stderr == nil {
+		return os.Stderr
+	}
+	return e.Stderr
+}
+
+// Cmd describes a single command to be executed.
+type Cmd struct {
+	Name string
+	Args []string
+}
+
+// String returns a human readable version of the command.
+func (c Cmd) String() string {
+	return fmt.Sprintf("%s %q", c.Name, c.Args)
+}
+
+// Pipeline returns a human readable version of the given commands, joined like a shell pipeline.
+func Pipeline(cmds []Cmd) string {
+	s := make([]string, len(cmds))
+	for i, c := range cmds {
+		s[i] = c.String()
+	}
+	return strings.Join(s, " | ")
 }
 
 func (e *Exec) Execute(name string, args ...string) error {
 	if e.DryRun {
-		fmt.Printf("Would execute: %s %q\n", name, args)
+		e.Printf("Would execute: %s %q\n", name, args)
 		return nil
 	}
 	if e.Verbose {
-		fmt.Printf("Executing %s %q\n", name, args)
+		e.Printf("Executing %s %q\n", name, args)
 	}
 
 	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = e.stdout()
+	cmd.Stderr = e.stderr()
 	return cmd.Run()
 }
+
+// WriteFile replaces the content of the file at path with data.
+func (e *Exec) WriteFile(path string, data []byte) error {
+	if e.DryRun {
+		e.Printf("Would write %s\n", path)
+		return nil
+	}
+	if e.Verbose {
+		e.Printf("Writing %s\n", path)
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Remove removes the file at path. A missing file is not an error.
+func (e *Exec) Remove(path string) error {
+	if e.DryRun {
+		e.Printf("Would remove %s\n", path)
+		return nil
+	}
+	if e.Verbose {
+		e.Printf("Removing %s\n", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Output runs the given pipeline and returns its output.
+// Commands are executed even in dry run mode: callers must only use this for read-only queries.
+func (e *Exec) Output(cmds []Cmd) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	procs, err := start(cmds, nil, buf, e.stderr())
+	if err != nil {
+		return nil, err
+	}
+	if err := wait(procs); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// QueryError is returned by Query if the pipeline failed.
+type QueryError struct {
+	Err error
+	// Stderr is the error output of the pipeline.
+	Stderr []byte
+}
+
+func (e *QueryError) Error() string {
+	msg := strings.TrimSpace(string(e.Stderr))
+	if msg == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.Err, msg)
+}
+
+// Query runs the given pipeline and returns its output, like Output. Instead of printing the error output,
+// it is returned as part of a *QueryError if the pipeline fails, so callers can tell the cause apart.
+func (e *Exec) Query(cmds []Cmd) ([]byte, error) {
+	buf, ebuf := &bytes.Buffer{}, &bytes.Buffer{}
+	procs, err := start(cmds, nil, buf, ebuf)
+	if err != nil {
+		return nil, err
+	}
+	if err := wait(procs); err != nil {
+		return nil, &QueryError{Err: err, Stderr: ebuf.Bytes()}
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadFrom runs the given pipeline and calls fn with a reader returning its output.
+// The reader returns an error instead of io.EOF if any of the commands failed.
+func (e *Exec) ReadFrom(cmds []Cmd, fn func(io.Reader) error) error {
+	if e.DryRun {
+		e.Printf("Would execute: %s\n", Pipeline(cmds))
+		return nil
+	}
+	if e.Verbose {
+		e.Printf("Executing %s\n", Pipeline(cmds))
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	procs, err := start(cmds, nil, pw, e.stderr())
+	pw.Close()
+	if err != nil {
+		pr.Close()
+		return err
+	}
+
+	r := &procReader{r: pr, procs: procs}
+	ferr := fn(r)
+	werr := r.Close()
+	if ferr != nil {
+		return ferr
+	}
+	return werr
+}
+
+// WriteTo runs the given pipeline, feeding r into its first command.
+func (e *Exec) WriteTo(cmds []Cmd, r io.Reader) error {
+	if e.DryRun {
+		e.Printf("Would execute: %s\n", Pipeline(cmds))
+		return nil
+	}
+	if e.Verbose {
+		e.Printf("Executing %s\n", Pipeline(cmds))
+	}
+
+	procs, err := start(cmds, r, e.stdout(), e.stderr())
+	if err != nil {
+		return err
+	}
+	return wait(procs)
+}
+
+// Pipe feeds the output of the src pipeline into the dst pipeline.
+// Data is passed through filter if non-nil. Filters implementing io.Closer are closed once the transfer is done.
+func (e *Exec) Pipe(src []Cmd, filter func(io.Reader) io.Reader, dst []Cmd) error {
+	if e.DryRun {
+		e.Printf("Would execute: %s | %s\n", Pipeline(src), Pipeline(dst))
+		return nil
+	}
+	return e.ReadFrom(src, func(r io.Reader) error {
+		if filter != nil {
+			r = filter(r)
+			if c, ok := r.(io.Closer); ok {
+				defer c.Close()
+			}
+		}
+		return e.WriteTo(dst, r)
+	})
+}
+
+// start launches all commands, connecting the output of each command to the input of the next one.
+func start(cmds []Cmd, stdin io.Reader, stdout, stderr io.Writer) ([]*exec.Cmd, error) {
+	if len(cmds) == 0 {
+		return nil, fmt.Errorf("empty pipeline")
+	}
+
+	procs := make([]*exec.Cmd, 0, len(cmds))
+	in := stdin
+	for i, c := range cmds {
+		p := exec.Command(c.Name, c.Args...)
+		p.Stdin = in
+		p.Stderr = stderr
+
+		var pr, pw *os.File
+		if i == len(cmds)-1 {
+			p.Stdout = stdout
+		} else {
+			var err error
+			if pr, pw, err = os.Pipe(); err != nil {
+				abort(procs)
+				return nil, err
+			}
+			p.Stdout = pw
+		}
+
+		err := p.Start()
+		// The child holds its own copies of the pipe ends.
+		if pw != nil {
+			pw.Close()
+		}
+		if f, ok := in.(*os.File); ok && i > 0 {
+			f.Close()
+		}
+		if err != nil {
+			if pr != nil {
+				pr.Close()
+			}
+			abort(procs)
+			return nil, fmt.Errorf("%s: %v", c.Name, err)
+		}
+		procs = append(procs, p)
+		if pr != nil {
+			in = pr
+		}
+	}
+	return procs, nil
+}
+
+// wait waits for all processes to exit and returns the first error encountered.
+func wait(procs []*exec.Cmd) error {
+	var ret error
+	for _, p := range procs {
+		if err := p.Wait(); err != nil && ret == nil {
+			ret = fmt.Errorf("%s: %v", p.Path, err)
+		}
+	}
+	return ret
+}
+
+// abort kills and reaps the given processes.
+func abort(procs []*exec.Cmd) {
+	for _, p := range procs {
+		p.Process.Kill()
+	}
+	wait(procs)
+}
+
+// procReader reads the output of a pipeline and reports failures of the pipeline on EOF.
+type procReader struct {
+	r     *os.File
+	procs []*exec.Cmd
+	done  bool
+	err   error
+}
+
+func (p *procReader) Read(b []byte) (int, error) {
+	if p.done {
+		if p.err != nil {
+			return 0, p.err
+		}
+		return 0, io.EOF
+	}
+	n, err := p.r.Read(b)
+	if err == io.EOF {
+		p.done = true
+		if p.err = wait(p.procs); p.err != nil {
+			return n, p.err
+		}
+	}
+	return n, err
+}
+
+// Close terminates the pipeline if it did not finish yet and returns its exit status.
+func (p *procReader) Close() error {
+	p.r.Close()
+	if !p.done {
+		p.done = true
+		p.err = wait(p.procs)
+	}
+	return p.err
+}
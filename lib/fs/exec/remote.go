@@ -0,0 +1,68 @@
+package exec
+
+import (
+	"regexp"
+	"strings"
+)
+
+var reShellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Remote describes a host reachable via ssh.
+type Remote struct {
+	Host string
+	User string
+	Port string
+	// Command is the ssh binary to invoke, defaults to 'ssh'.
+	Command string
+	// Options are passed to ssh in front of the destination.
+	Options []string
+}
+
+// Wrap returns a pipeline executing cmds on the remote host.
+// A nil remote returns cmds unchanged, so callers can treat local and remote targets alike.
+func (r *Remote) Wrap(cmds ...Cmd) []Cmd {
+	if r == nil {
+		return cmds
+	}
+
+	s := make([]string, len(cmds))
+	for i, c := range cmds {
+		s[i] = shellJoin(c)
+	}
+
+	name := r.Command
+	if name == "" {
+		name = "ssh"
+	}
+	args := append([]string{}, r.Options...)
+	if r.Port != "" {
+		args = append(args, "-p", r.Port)
+	}
+	args = append(args, r.Destination(), strings.Join(s, " | "))
+	return []Cmd{{Name: name, Args: args}}
+}
+
+// Destination returns the ssh destination, e.g. 'user@host'.
+func (r *Remote) Destination() string {
+	if r.User == "" {
+		return r.Host
+	}
+	return r.User + "@" + r.Host
+}
+
+// shellJoin converts c into a string which can be passed to a POSIX shell.
+func shellJoin(c Cmd) string {
+	s := []string{shellQuote(c.Name)}
+	for _, a := range c.Args {
+		s = append(s, shellQuote(a))
+	}
+	return strings.Join(s, " ")
+}
+
+// shellQuote quotes s for use in a POSIX shell, if required.
+func shellQuote(s string) string {
+	if reShellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
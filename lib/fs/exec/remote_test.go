@@ -0,0 +1,48 @@
+package exec
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWrap(t *testing.T) {
+	cmds := []Cmd{
+		{Name: "zstd", Args: []string{"-q", "-d", "-c"}},
+		{Name: "zfs", Args: []string{"receive", "-u", "-F", "backup/it's here"}},
+	}
+
+	input := []struct {
+		name   string
+		remote *Remote
+		want   []Cmd
+	}{
+		{
+			name: "local",
+			want: cmds,
+		},
+		{
+			name:   "remote",
+			remote: &Remote{Host: "nas", User: "root", Port: "2222", Options: []string{"-i", "/root/.ssh/id"}},
+			want: []Cmd{{
+				Name: "ssh",
+				Args: []string{"-i", "/root/.ssh/id", "-p", "2222", "root@nas", `zstd -q -d -c | zfs receive -u -F 'backup/it'"'"'s here'`},
+			}},
+		},
+		{
+			name:   "custom command",
+			remote: &Remote{Host: "nas", Command: "/usr/local/bin/ssh-stub"},
+			want: []Cmd{{
+				Name: "/usr/local/bin/ssh-stub",
+				Args: []string{"nas", `zstd -q -d -c | zfs receive -u -F 'backup/it'"'"'s here'`},
+			}},
+		},
+	}
+
+	for _, tt := range input {
+		got := tt.remote.Wrap(cmds...)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("Wrap(%s) mismatch (-want +got)\n%s", tt.name, diff)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package fs
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/adrian-bl/minisnap/lib/fs/zfs"
+)
+
+// ZFSPrefix marks target patterns matching ZFS dataset names instead of paths, e.g. 'zfs:tank/vm/*'.
+const ZFSPrefix = "zfs:"
+
+// IsPattern returns true if the target t has to be expanded by Expand.
+func IsPattern(t string) bool {
+	return strings.HasPrefix(t, ZFSPrefix) || strings.ContainsAny(t, "*?[")
+}
+
+// Expand returns the mountpoints of all volumes matching the target pattern t, sorted.
+// Patterns starting with ZFSPrefix match dataset names, all others match the paths of mounted volumes.
+// Volumes matching any of the patterns in exclude are skipped. Wildcards do not match '/'.
+func Expand(t string, exclude []string) ([]string, error) {
+	if strings.HasPrefix(t, ZFSPrefix) {
+		mounts, err := zfs.Mountpoints()
+		if err != nil {
+			return nil, err
+		}
+		return matchDatasets(strings.TrimPrefix(t, ZFSPrefix), exclude, mounts)
+	}
+	return matchPaths(t, exclude, Mounted)
+}
+
+// matchDatasets returns the mountpoints of the datasets in mounts matching pattern but none of exclude.
+func matchDatasets(pattern string, exclude []string, mounts map[string]string) ([]string, error) {
+	var vols []string
+	for name, mp := range mounts {
+		ok, err := matches(name, pattern, exclude)
+		if err != nil {
+			return nil, err
+		}
+		if ok && filepath.IsAbs(mp) {
+			vols = append(vols, mp)
+		}
+	}
+	sort.Strings(vols)
+	return vols, nil
+}
+
+// matchPaths returns the mounted paths matching pattern but none of exclude.
+func matchPaths(pattern string, exclude []string, mounted func(string) (bool, error)) ([]string, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var vols []string
+	for _, p := range paths {
+		ok, err := matches(p, pattern, exclude)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if ok, err = mounted(p); err != nil {
+			return nil, err
+		}
+		if ok {
+			vols = append(vols, p)
+		}
+	}
+	return vols, nil
+}
+
+// matches returns true if name matches pattern and none of exclude.
+func matches(name, pattern string, exclude []string) (bool, error) {
+	ok, err := path.Match(pattern, name)
+	if err != nil || !ok {
+		return false, err
+	}
+	for _, x := range exclude {
+		ok, err := path.Match(x, name)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMatchDatasets(t *testing.T) {
+	mounts := map[string]string{
+		"tank":            "/tank",
+		"tank/vm":         "/tank/vm",
+		"tank/vm/web":     "/srv/web",
+		"tank/vm/db":      "/srv/db",
+		"tank/vm/db/logs": "/srv/db/logs",
+		"tank/vm/tmp":     "none",
+		"tank/vm/scratch": "/srv/scratch",
+	}
+
+	input := []struct {
+		pattern string
+		exclude []string
+		want    []string
+	}{
+		{
+			pattern: "tank/vm/*",
+			want:    []string{"/srv/db", "/srv/scratch", "/srv/web"},
+		},
+		{
+			pattern: "tank/vm/*",
+			exclude: []string{"tank/vm/scratch", "tank/*/web"},
+			want:    []string{"/srv/db"},
+		},
+		{
+			pattern: "tank/vm",
+			want:    []string{"/tank/vm"},
+		},
+		{
+			pattern: "pool/*",
+		},
+	}
+
+	for _, tt := range input {
+		got, err := matchDatasets(tt.pattern, tt.exclude, mounts)
+		if err != nil {
+			t.Errorf("matchDatasets(%s, %v) = _, %v, want nil err", tt.pattern, tt.exclude, err)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("matchDatasets(%s, %v) mismatch (-want +got)\n%s", tt.pattern, tt.exclude, diff)
+		}
+	}
+
+	if _, err := matchDatasets("tank/[", nil, mounts); err == nil {
+		t.Errorf("matchDatasets() of bad pattern = _, nil, want err")
+	}
+}
+
+func TestMatchPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"a", "b", "c", "unmounted"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mounted := func(p string) (bool, error) {
+		return filepath.Base(p) != "unmounted", nil
+	}
+
+	got, err := matchPaths(filepath.Join(dir, "*"), []string{filepath.Join(dir, "b")}, mounted)
+	if err != nil {
+		t.Fatalf("matchPaths() = _, %v, want nil err", err)
+	}
+	want := []string{filepath.Join(dir, "a"), filepath.Join(dir, "c")}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("matchPaths() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestIsPattern(t *testing.T) {
+	input := map[string]bool{
+		"/srv":         false,
+		"/srv/*":       true,
+		"/srv/vm[0-9]": true,
+		"zfs:tank/vm":  true,
+	}
+	for in, want := range input {
+		if got := IsPattern(in); got != want {
+			t.Errorf("IsPattern(%s) = %v, want %v", in, got, want)
+		}
+	}
+}
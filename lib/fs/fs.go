@@ -2,8 +2,12 @@ package fs
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/adrian-bl/minisnap/lib/foreign"
 	"github.com/adrian-bl/minisnap/lib/fs/btrfs"
 	"github.com/adrian-bl/minisnap/lib/fs/exec"
 	"github.com/adrian-bl/minisnap/lib/fs/zfs"
@@ -16,6 +20,11 @@ const (
 	fsZFS   = 0x2FC12FC1
 )
 
+const (
+	btrfsSnapdir = ".snapshots"
+	zfsPrefix    = "msnap_"
+)
+
 type FsSnap interface {
 	Description() string
 	Gather() ([]*snapobj.SnapObj, error)
@@ -23,24 +32,155 @@ type FsSnap interface {
 	Delete(*snapobj.SnapObj) error
 }
 
-func ForVolume(path string, vopts opts.VolOptions, dryRun, verbose bool) (FsSnap, error) {
+// Sender is implemented by filesystems which are able to serialize snapshots into a stream.
+type Sender interface {
+	FsSnap
+	// Kind returns the stream format, as accepted by NewReceiver.
+	Kind() string
+	// Send returns the command writing a snapshot to stdout, incremental to base if non-nil.
+	Send(base, s *snapobj.SnapObj) exec.Cmd
+}
+
+// Sizer is implemented by filesystems which are able to report the space used by snapshots.
+type Sizer interface {
+	// Sizes returns the space used by each snapshot in bytes, keyed by SnapObj.FileName().
+	Sizes() (map[string]int64, error)
+}
+
+// Pooler is implemented by filesystems whose volumes are part of a larger storage pool.
+type Pooler interface {
+	// Pool returns the name of the pool holding the volume.
+	Pool() string
+}
+
+// Estimator is implemented by senders which are able to predict the size of a stream.
+type Estimator interface {
+	// Estimate returns the command printing the expected size of the stream produced by send,
+	// false if the size of this stream can not be estimated.
+	Estimate(send exec.Cmd) (exec.Cmd, bool)
+	// ParseEstimate converts the output of an Estimate command into bytes.
+	ParseEstimate(out []byte) (int64, error)
+}
+
+// Bookmarker is implemented by senders which are able to keep the base of incremental streams
+// after the snapshot itself was deleted.
+type Bookmarker interface {
+	// Bookmarks returns the snapshots bookmarks exist for.
+	Bookmarks() ([]*snapobj.SnapObj, error)
+	Bookmark(*snapobj.SnapObj) error
+	DeleteBookmark(*snapobj.SnapObj) error
+	// SendFromBookmark returns the command writing s to stdout, incremental to the bookmark of base.
+	SendFromBookmark(base, s *snapobj.SnapObj) exec.Cmd
+}
+
+// Annotator is implemented by filesystems which are able to store metadata with snapshots.
+type Annotator interface {
+	// Annotate stores the key/value pairs of meta with s, replacing existing values of the same keys.
+	Annotate(s *snapobj.SnapObj, meta map[string]string) error
+}
+
+// Renamer is implemented by filesystems which are able to migrate adopted snapshots.
+type Renamer interface {
+	// Rename gives the adopted snapshot s the name returned by its FileName method.
+	Rename(s *snapobj.SnapObj) error
+}
+
+// Namer is implemented by filesystems whose snapshot names follow a template.
+type Namer interface {
+	// Naming returns the template of the snapshot names, nil for the legacy format.
+	Naming() *snapobj.Template
+}
+
+// Receiver consumes streams produced by a Sender.
+type Receiver interface {
+	// Receive returns the command reading a stream from stdin into dest.
+	Receive(dest string) exec.Cmd
+	// List returns the command listing the snapshots present at dest.
+	List(dest string) exec.Cmd
+	// Parse converts the output of List into snapshot objects.
+	Parse(dest string, out []byte) ([]*snapobj.SnapObj, error)
+	// Missing returns true if stderr, the error output of a failed List command, says that dest does not exist.
+	Missing(stderr []byte) bool
+}
+
+// Resumer is implemented by receivers which are able to continue interrupted streams.
+type Resumer interface {
+	// ResumeToken returns the command printing the resume token of dest.
+	ResumeToken(dest string) exec.Cmd
+	// ParseResumeToken converts the output of ResumeToken into a token, empty if there is nothing to resume.
+	ParseResumeToken(out []byte) string
+	// Resume returns the command continuing the interrupted stream described by token.
+	Resume(token string) exec.Cmd
+}
+
+// NewReceiver returns a receiver for streams of the given kind, whose snapshots are named using tmpl.
+func NewReceiver(kind string, tmpl *snapobj.Template) (Receiver, error) {
+	switch kind {
+	case "btrfs":
+		return btrfs.Receiver{Naming: tmpl}, nil
+	case "zfs":
+		return zfs.Receiver{SnapPrefix: zfsPrefix, Naming: tmpl}, nil
+	}
+	return nil, fmt.Errorf("unknown stream kind '%s'", kind)
+}
+
+func ForVolume(path string, vopts opts.VolOptions, e *exec.Exec) (FsSnap, error) {
 	buf := &syscall.Statfs_t{}
 	if err := syscall.Statfs(path, buf); err != nil {
 		return nil, err
 	}
 
-	e := &exec.Exec{
-		DryRun:  dryRun,
-		Verbose: verbose,
+	var tmpl *snapobj.Template
+	if vopts.Naming != "" {
+		var err error
+		if tmpl, err = snapobj.ParseTemplate(vopts.Naming); err != nil {
+			return nil, err
+		}
 	}
+
 	switch buf.Type {
 	case fsBtrfs:
 		if vopts.Recursive {
 			return nil, fmt.Errorf("btrfs does not support recursive snapshots")
 		}
-		return btrfs.New(path, ".snapshots", e), nil
+		if vopts.Sends() && !vopts.ReadOnly {
+			return nil, fmt.Errorf("btrfs can only send read-only snapshots, set 'readonly: true'")
+		}
+		var snapper bool
+		for _, t := range vopts.Adopt {
+			if t != foreign.Snapper {
+				return nil, fmt.Errorf("can not adopt snapshots of '%s' on btrfs", t)
+			}
+			snapper = true
+		}
+		return btrfs.New(path, btrfsSnapdir, e, vopts.ReadOnly, tmpl, snapper), nil
 	case fsZFS:
-		return zfs.New(path, "msnap_", e, vopts.Recursive)
+		if vopts.Recursive && vopts.Replicate != nil && vopts.Replicate.Bookmarks > 0 {
+			return nil, fmt.Errorf("bookmarks are not supported for recursive snapshots")
+		}
+		adopt, err := foreign.ForZFS(vopts.Adopt, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		return zfs.New(path, zfsPrefix, e, vopts.Recursive, tmpl, adopt)
 	}
 	return nil, fmt.Errorf("Unknown fstype: %X", buf.Type)
 }
+
+// Mounted returns true if path exists and is the root of a mounted filesystem, or of a btrfs subvolume.
+// A missing path or an empty mountpoint directory of an unmounted filesystem returns false.
+func Mounted(path string) (bool, error) {
+	st := &syscall.Stat_t{}
+	if err := syscall.Stat(path, st); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	pst := &syscall.Stat_t{}
+	if err := syscall.Stat(filepath.Dir(path), pst); err != nil {
+		return false, err
+	}
+	// The root directory is its own parent.
+	return st.Dev != pst.Dev || st.Ino == pst.Ino, nil
+}
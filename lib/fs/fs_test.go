@@ -0,0 +1,38 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "mnt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	input := []struct {
+		path string
+		want bool
+	}{
+		{path: "/", want: true},
+		{path: filepath.Join(dir, "mnt"), want: false},
+		{path: filepath.Join(dir, "absent"), want: false},
+	}
+
+	for _, tt := range input {
+		got, err := Mounted(tt.path)
+		if err != nil {
+			t.Errorf("Mounted(%s) = _, %v, want nil err", tt.path, err)
+		}
+		if got != tt.want {
+			t.Errorf("Mounted(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
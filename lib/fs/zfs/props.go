@@ -0,0 +1,86 @@
+package zfs
+
+import (
+	"bytes"
+	"fmt"
+	oe "os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+)
+
+// ScheduleProperty is the user property selecting datasets for snapshots, e.g. 'hourly=24,daily=7'.
+// Like any user property, it is inherited by child datasets. A value of 'false' opts a dataset out.
+const ScheduleProperty = "minisnap:schedule"
+
+// MetaPrefix is prepended to the keys of snapshot metadata to form user property names, e.g. 'minisnap:command'.
+const MetaPrefix = "minisnap:"
+
+// Scheduled is a filesystem on which ScheduleProperty is set or inherited.
+type Scheduled struct {
+	Dataset    string
+	Mountpoint string
+	// Value is the value of ScheduleProperty, as accepted by ParseSchedule.
+	Value string
+}
+
+// ScheduledDatasets returns all filesystems which have a value for ScheduleProperty.
+func ScheduledDatasets() ([]Scheduled, error) {
+	cmd := oe.Command("zfs", "list", "-H", "-t", "filesystem", "-o", "name,mountpoint,"+ScheduleProperty)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseScheduled(out)
+}
+
+// parseScheduled converts the output of 'zfs list' as run by ScheduledDatasets.
+func parseScheduled(out []byte) ([]Scheduled, error) {
+	var sd []Scheduled
+	for _, l := range bytes.Split(out, []byte{'\n'}) {
+		if len(l) == 0 {
+			continue
+		}
+		f := strings.Split(string(l), "\t")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("error parsing line %s", string(l))
+		}
+		// Unset user properties are shown as '-'.
+		if f[2] == "-" {
+			continue
+		}
+		sd = append(sd, Scheduled{Dataset: f[0], Mountpoint: f[1], Value: f[2]})
+	}
+	return sd, nil
+}
+
+// ParseSchedule converts a value of ScheduleProperty into the number of snapshots to keep per type.
+// It returns a nil schedule if the value opts out of snapshots.
+func ParseSchedule(v string) (map[snapobj.Type]int, error) {
+	switch strings.TrimSpace(v) {
+	case "false", "off", "none":
+		return nil, nil
+	}
+
+	keep := make(map[snapobj.Type]int)
+	for _, e := range strings.Split(v, ",") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid entry '%s', want type=count", e)
+		}
+		st, err := snapobj.ToType(strings.TrimSpace(kv[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%v '%s'", err, kv[0])
+		}
+		if _, ok := keep[st]; ok {
+			return nil, fmt.Errorf("type '%s' given multiple times", st)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid count for %s: %v", st, err)
+		}
+		keep[st] = n
+	}
+	return keep, nil
+}
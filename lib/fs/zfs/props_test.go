@@ -0,0 +1,72 @@
+package zfs
+
+import (
+	"testing"
+
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSchedule(t *testing.T) {
+	input := []struct {
+		value   string
+		want    map[snapobj.Type]int
+		wantErr bool
+	}{
+		{
+			value: "hourly=24,daily=7",
+			want:  map[snapobj.Type]int{snapobj.Hourly: 24, snapobj.Daily: 7},
+		},
+		{
+			value: " weekly = 4 ",
+			want:  map[snapobj.Type]int{snapobj.Weekly: 4},
+		},
+		{
+			value: "false",
+		},
+		{
+			value:   "hourly",
+			wantErr: true,
+		},
+		{
+			value:   "hourly=x",
+			wantErr: true,
+		},
+		{
+			value:   "fortnightly=2",
+			wantErr: true,
+		},
+		{
+			value:   "daily=1,daily=2",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range input {
+		got, err := ParseSchedule(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSchedule(%s) = _, %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("ParseSchedule(%s) mismatch (-want +got)\n%s", tt.value, diff)
+		}
+	}
+}
+
+func TestParseScheduled(t *testing.T) {
+	out := []byte("tank\t/tank\t-\n" +
+		"tank/vm\t/srv/vm\thourly=24\n" +
+		"tank/vm/scratch\t/srv/vm/scratch\tfalse\n")
+
+	want := []Scheduled{
+		{Dataset: "tank/vm", Mountpoint: "/srv/vm", Value: "hourly=24"},
+		{Dataset: "tank/vm/scratch", Mountpoint: "/srv/vm/scratch", Value: "false"},
+	}
+	got, err := parseScheduled(out)
+	if err != nil {
+		t.Fatalf("parseScheduled() = _, %v, want nil err", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseScheduled() mismatch (-want +got)\n%s", diff)
+	}
+}
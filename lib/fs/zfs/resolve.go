@@ -11,12 +11,28 @@ var reSplitMounts = regexp.MustCompile(`^(.+)\s+(.+)$`)
 
 // resolveZfsMount finds the volume name of a given mountpoint.
 func resolveZfsMount(mp string) (string, error) {
+	mounts, err := Mountpoints()
+	if err != nil {
+		return "", err
+	}
+	for name, m := range mounts {
+		if m == mp {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find name of mountpoint %s", mp)
+}
+
+// Mountpoints returns the mountpoints of all ZFS filesystems, keyed by dataset name.
+// Filesystems which are not mounted by ZFS have a mountpoint of 'none', 'legacy' or '-'.
+func Mountpoints() (map[string]string, error) {
 	cmd := exec.Command("zfs", "list", "-H", "-o", "name,mountpoint")
 	out, err := cmd.Output()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	mounts := make(map[string]string)
 	for _, l := range bytes.Split(out, []byte{'\n'}) {
 		if len(l) == 0 {
 			continue
@@ -24,11 +40,9 @@ func resolveZfsMount(mp string) (string, error) {
 
 		m := reSplitMounts.FindSubmatch(l)
 		if len(m) != 3 {
-			return "", fmt.Errorf("error parsing line %s", string(l))
-		}
-		if string(m[2]) == mp {
-			return string(m[1]), nil
+			return nil, fmt.Errorf("error parsing line %s", string(l))
 		}
+		mounts[string(m[1])] = string(m[2])
 	}
-	return "", fmt.Errorf("failed to find name of mountpoint %s", mp)
+	return mounts, nil
 }
@@ -1,11 +1,13 @@
 package zfs
 
 import (
-	"bytes"
 	"fmt"
 	oe "os/exec"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/adrian-bl/minisnap/lib/foreign"
 	"github.com/adrian-bl/minisnap/lib/fs/exec"
 	"github.com/adrian-bl/minisnap/lib/snapobj"
 )
@@ -13,12 +15,12 @@ import (
 type Zfs struct {
 	name       string
 	mountpoint string
-	snapprefix string
+	names      naming
 	recursive  bool
 	exec       *exec.Exec
 }
 
-func New(path, sprefix string, e *exec.Exec, recursive bool) (*Zfs, error) {
+func New(path, sprefix string, e *exec.Exec, recursive bool, tmpl *snapobj.Template, adopt []foreign.Parser) (*Zfs, error) {
 	name, err := resolveZfsMount(path)
 	if err != nil {
 		return nil, err
@@ -26,7 +28,7 @@ func New(path, sprefix string, e *exec.Exec, recursive bool) (*Zfs, error) {
 	z := &Zfs{
 		mountpoint: path,
 		name:       name,
-		snapprefix: sprefix,
+		names:      naming{prefix: sprefix, tmpl: tmpl, adopt: adopt},
 		recursive:  recursive,
 		exec:       e,
 	}
@@ -37,39 +39,128 @@ func (z *Zfs) Description() string {
 	return fmt.Sprintf("%s using ZFS vol %s", z.mountpoint, z.name)
 }
 
+// Dataset returns the name of the dataset.
+func (z *Zfs) Dataset() string {
+	return z.name
+}
+
+// Pool returns the name of the zpool holding the dataset.
+func (z *Zfs) Pool() string {
+	return strings.SplitN(z.name, "/", 2)[0]
+}
+
+// Gather returns the snapshots of the dataset, along with the metadata stored in their user properties.
 func (z *Zfs) Gather() ([]*snapobj.SnapObj, error) {
-	cmd := oe.Command("zfs", "list", "-H", "-t", "snapshot", "-o", "name", z.name)
+	cols := []string{"name"}
+	for _, k := range snapobj.MetaKeys {
+		cols = append(cols, MetaPrefix+k)
+	}
+	cmd := oe.Command("zfs", "list", "-H", "-t", "snapshot", "-o", strings.Join(cols, ","), z.name)
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, err
 	}
+	return parseSnapshots(z.name+"@", z.names, out)
+}
 
+// parseSnapshots converts the output of 'zfs list' into snapshot objects.
+// Only names starting with base, the dataset followed by '@' or '#', are considered, and only those
+// recognized by names are returned.
+// Columns following the name are the values of the metadata properties in the order of
+// snapobj.MetaKeys, '-' if unset.
+func parseSnapshots(base string, names naming, out []byte) ([]*snapobj.SnapObj, error) {
 	e := []*snapobj.SnapObj{}
-	pfx := []byte(fmt.Sprintf("%s@%s", z.name, z.snapprefix))
-	for _, l := range bytes.Split(out, []byte{'\n'}) {
+	for _, l := range strings.Split(string(out), "\n") {
 		if len(l) == 0 {
 			continue
 		}
-		if bytes.Compare(l, pfx) < 1 {
-			// not a snapshot managed by us.
+		cols := strings.Split(l, "\t")
+		if !strings.HasPrefix(cols[0], base) {
 			continue
 		}
-		// convert back into something snapobj understands: must agree with snapName().
-		id := strings.Replace(string(l[len(pfx):]), "::", "@", 1)
-		so, err := snapobj.FromString(id)
+		so, err := names.parse(cols[0][len(base):])
 		if err != nil {
 			return nil, err
 		}
+		if so == nil {
+			// not a snapshot managed by us.
+			continue
+		}
+		for i, v := range cols[1:] {
+			if i >= len(snapobj.MetaKeys) || len(v) == 0 || v == "-" {
+				continue
+			}
+			if so.Meta == nil {
+				so.Meta = make(map[string]string)
+			}
+			so.Meta[snapobj.MetaKeys[i]] = v
+		}
 		e = append(e, so)
 	}
 	return e, nil
 }
 
+// naming converts between snapshot objects and the names of ZFS snapshots, without the dataset.
+type naming struct {
+	prefix string
+	// tmpl names our snapshots, the legacy '<type>::<time>' format is used if nil.
+	tmpl *snapobj.Template
+	// adopt recognizes the snapshots of other tools, which are managed like our own.
+	adopt []foreign.Parser
+}
+
+// parse converts the snapshot name n into a snap object.
+// It returns nil if n is neither one of our own snapshots nor recognized by the adopt parsers.
+// With a template, names in the legacy format are returned as adopted snapshots, so they get migrated.
+func (nm naming) parse(n string) (*snapobj.SnapObj, error) {
+	if strings.HasPrefix(n, nm.prefix) {
+		if nm.tmpl != nil {
+			if so, err := nm.tmpl.Parse(n[len(nm.prefix):]); err == nil {
+				return so, nil
+			}
+		}
+		// convert back into something snapobj understands: must agree with native().
+		so, err := snapobj.FromString(strings.Replace(n[len(nm.prefix):], "::", "@", -1))
+		if err != nil {
+			return nil, err
+		}
+		if nm.tmpl != nil {
+			so.Source = n
+		}
+		return so, nil
+	}
+	for _, p := range nm.adopt {
+		if so, ok := p.Parse(n); ok {
+			return so, nil
+		}
+	}
+	return nil, nil
+}
+
+// name returns the current name of s.
+func (nm naming) name(s *snapobj.SnapObj) string {
+	if s.Adopted() {
+		return s.Source
+	}
+	return nm.native(s)
+}
+
+// native returns the name we give s, which differs from name for adopted snapshots.
+func (nm naming) native(s *snapobj.SnapObj) string {
+	if nm.tmpl != nil {
+		return nm.prefix + nm.tmpl.Format(s)
+	}
+	// zfs can not contain @ signs in snapshot names, manual snapshots have several.
+	return nm.prefix + strings.Replace(s.FileName(), "@", "::", -1)
+}
+
+// Create creates the snapshot s, storing its metadata as user properties.
 func (z *Zfs) Create(s *snapobj.SnapObj) error {
 	args := []string{"snapshot"}
 	if z.recursive {
 		args = append(args, "-r")
 	}
+	args = append(args, metaArgs("-o", s.Meta)...)
 	args = append(args, fmt.Sprintf("%s@%s", z.name, z.snapName(s)))
 	return z.exec.Execute("zfs", args...)
 }
@@ -83,8 +174,193 @@ func (z *Zfs) Delete(s *snapobj.SnapObj) error {
 	return z.exec.Execute("zfs", args...)
 }
 
+// Rename gives the adopted snapshot s our own name.
+func (z *Zfs) Rename(s *snapobj.SnapObj) error {
+	args := []string{"rename"}
+	if z.recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, fmt.Sprintf("%s@%s", z.name, z.snapName(s)), fmt.Sprintf("%s@%s", z.name, z.names.native(s)))
+	return z.exec.Execute("zfs", args...)
+}
+
+// Annotate stores meta as user properties of the snapshot, prefixed by MetaPrefix.
+func (z *Zfs) Annotate(s *snapobj.SnapObj, meta map[string]string) error {
+	args := append([]string{"set"}, metaArgs("", meta)...)
+	args = append(args, fmt.Sprintf("%s@%s", z.name, z.snapName(s)))
+	return z.exec.Execute("zfs", args...)
+}
+
+// metaArgs returns the 'property=value' arguments setting the user properties of meta, sorted by key.
+// If flag is non-empty, it is passed before each of them.
+func metaArgs(flag string, meta map[string]string) []string {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, k := range keys {
+		if flag != "" {
+			args = append(args, flag)
+		}
+		args = append(args, fmt.Sprintf("%s%s=%s", MetaPrefix, k, meta[k]))
+	}
+	return args
+}
+
+// snapName returns the name of s, without the dataset.
 func (z *Zfs) snapName(s *snapobj.SnapObj) string {
-	// zfs can not contain @ signs in snapshot names.
-	sname := strings.Replace(s.FileName(), "@", "::", 1)
-	return fmt.Sprintf("%s%s", z.snapprefix, sname)
+	return z.names.name(s)
+}
+
+// Naming returns the template of the snapshot names, nil for the legacy format.
+func (z *Zfs) Naming() *snapobj.Template {
+	return z.names.tmpl
+}
+
+// Kind returns the stream format produced by Send.
+func (z *Zfs) Kind() string {
+	return "zfs"
+}
+
+// Send returns the command writing s to stdout, incremental to base if non-nil.
+func (z *Zfs) Send(base, s *snapobj.SnapObj) exec.Cmd {
+	args := []string{"send"}
+	if z.recursive {
+		args = append(args, "-R")
+	}
+	if base != nil {
+		args = append(args, "-i", fmt.Sprintf("%s@%s", z.name, z.snapName(base)))
+	}
+	args = append(args, fmt.Sprintf("%s@%s", z.name, z.snapName(s)))
+	return exec.Cmd{Name: "zfs", Args: args}
+}
+
+// Sizes returns the space used by each snapshot managed by us.
+func (z *Zfs) Sizes() (map[string]int64, error) {
+	cmd := oe.Command("zfs", "list", "-H", "-p", "-t", "snapshot", "-o", "name,used", z.name)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+	base := z.name + "@"
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Fields(l)
+		if len(f) != 2 || !strings.HasPrefix(f[0], base) {
+			continue
+		}
+		so, err := z.names.parse(f[0][len(base):])
+		if err != nil {
+			return nil, err
+		}
+		if so == nil {
+			continue
+		}
+		n, err := strconv.ParseInt(f[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sizes[so.FileName()] = n
+	}
+	return sizes, nil
+}
+
+// Bookmarks returns all bookmarks of snapshots managed by us.
+func (z *Zfs) Bookmarks() ([]*snapobj.SnapObj, error) {
+	cmd := oe.Command("zfs", "list", "-H", "-t", "bookmark", "-o", "name", z.name)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	// Adopted snapshots are never replicated, so there are no bookmarks of them.
+	return parseSnapshots(z.name+"#", naming{prefix: z.names.prefix, tmpl: z.names.tmpl}, out)
+}
+
+// Bookmark creates a bookmark of s.
+func (z *Zfs) Bookmark(s *snapobj.SnapObj) error {
+	if z.recursive {
+		return fmt.Errorf("bookmarks are not supported for recursive snapshots")
+	}
+	return z.exec.Execute("zfs", "bookmark", fmt.Sprintf("%s@%s", z.name, z.snapName(s)), fmt.Sprintf("%s#%s", z.name, z.snapName(s)))
+}
+
+// DeleteBookmark removes the bookmark of s.
+func (z *Zfs) DeleteBookmark(s *snapobj.SnapObj) error {
+	return z.exec.Execute("zfs", "destroy", fmt.Sprintf("%s#%s", z.name, z.snapName(s)))
+}
+
+// SendFromBookmark returns the command writing s to stdout, incremental to the bookmark of base.
+func (z *Zfs) SendFromBookmark(base, s *snapobj.SnapObj) exec.Cmd {
+	return exec.Cmd{Name: "zfs", Args: []string{"send", "-i", fmt.Sprintf("%s#%s", z.name, z.snapName(base)), fmt.Sprintf("%s@%s", z.name, z.snapName(s))}}
+}
+
+// Estimate returns a dry run of the send command, printing the expected stream size.
+func (z *Zfs) Estimate(send exec.Cmd) (exec.Cmd, bool) {
+	if send.Name != "zfs" || len(send.Args) == 0 || send.Args[0] != "send" {
+		return exec.Cmd{}, false
+	}
+	args := append([]string{"send", "-n", "-P"}, send.Args[1:]...)
+	return exec.Cmd{Name: "zfs", Args: args}, true
+}
+
+// ParseEstimate returns the size reported by 'zfs send -nP'.
+func (z *Zfs) ParseEstimate(out []byte) (int64, error) {
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 2 && f[0] == "size" {
+			return strconv.ParseInt(f[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no size in estimate")
+}
+
+// Receiver consumes streams produced by 'zfs send'.
+type Receiver struct {
+	SnapPrefix string
+	// Naming is the template of the snapshot names, nil for the legacy format.
+	Naming *snapobj.Template
+}
+
+// Receive returns the command reading a stream from stdin into the dataset dest.
+// Interrupted receives keep their state, so they can be continued using Resume.
+func (r Receiver) Receive(dest string) exec.Cmd {
+	return exec.Cmd{Name: "zfs", Args: []string{"receive", "-s", "-u", "-F", dest}}
+}
+
+// List returns the command listing all snapshots of dest.
+func (r Receiver) List(dest string) exec.Cmd {
+	return exec.Cmd{Name: "zfs", Args: []string{"list", "-H", "-t", "snapshot", "-o", "name", dest}}
+}
+
+// Parse converts the output of List into snapshot objects.
+func (r Receiver) Parse(dest string, out []byte) ([]*snapobj.SnapObj, error) {
+	return parseSnapshots(dest+"@", naming{prefix: r.SnapPrefix, tmpl: r.Naming}, out)
+}
+
+// Missing returns true if stderr says that dest does not exist.
+func (r Receiver) Missing(stderr []byte) bool {
+	return strings.Contains(string(stderr), "dataset does not exist")
+}
+
+// ResumeToken returns the command printing the resume token of dest.
+func (r Receiver) ResumeToken(dest string) exec.Cmd {
+	return exec.Cmd{Name: "zfs", Args: []string{"get", "-H", "-o", "value", "receive_resume_token", dest}}
+}
+
+// ParseResumeToken converts the output of ResumeToken into a token, empty if there is nothing to resume.
+func (r Receiver) ParseResumeToken(out []byte) string {
+	t := strings.TrimSpace(string(out))
+	if t == "-" {
+		return ""
+	}
+	return t
+}
+
+// Resume returns the command continuing the interrupted stream described by token.
+func (r Receiver) Resume(token string) exec.Cmd {
+	return exec.Cmd{Name: "zfs", Args: []string{"send", "-t", token}}
 }
@@ -0,0 +1,108 @@
+package zfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/foreign"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSnapshots(t *testing.T) {
+	out := []byte("tank/foo@msnap_daily::1997-01-17T16:54:13Z\troot\thost\t1.0\t-\tmsnap run /foo\n" +
+		"tank/foo@msnap_manual::1997-01-18T16:54:13Z::pre-upgrade\t-\t-\t-\tbefore the upgrade\t-\n" +
+		"tank/foo@msnap_hourly::1997-01-19T16:54:13Z\n" +
+		"tank/foo@other\n" +
+		"tank/foo@autosnap_1997-01-20_16:54:13_daily\t-\t-\t-\t-\t-\n" +
+		"tank/foo@zfs-auto-snap_daily-1997-01-20-1654\n" +
+		"tank/foobar@msnap_daily::1997-01-17T16:54:13Z\n")
+
+	want := []*snapobj.SnapObj{
+		{
+			Type:  snapobj.Daily,
+			Epoch: time.Unix(853520053, 0).UTC(),
+			Meta: map[string]string{
+				snapobj.MetaCreator:  "root",
+				snapobj.MetaHostname: "host",
+				snapobj.MetaVersion:  "1.0",
+				snapobj.MetaCommand:  "msnap run /foo",
+			},
+		},
+		{
+			Type:  snapobj.Manual,
+			Epoch: time.Unix(853606453, 0).UTC(),
+			Label: "pre-upgrade",
+			Meta:  map[string]string{snapobj.MetaNote: "before the upgrade"},
+		},
+		{
+			Type:  snapobj.Hourly,
+			Epoch: time.Unix(853692853, 0).UTC(),
+		},
+		{
+			Type:   snapobj.Daily,
+			Epoch:  time.Unix(853779253, 0).UTC(),
+			Source: "autosnap_1997-01-20_16:54:13_daily",
+		},
+	}
+	adopt, err := foreign.ForZFS([]string{"sanoid"}, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseSnapshots("tank/foo@", naming{prefix: "msnap_", adopt: adopt}, out)
+	if err != nil {
+		t.Fatalf("parseSnapshots() = _, %v, want nil err", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseSnapshots() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestNamingTemplate(t *testing.T) {
+	tmpl, err := snapobj.ParseTemplate("{type}-{2006-01-02_1504}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm := naming{prefix: "msnap_", tmpl: tmpl}
+	out := []byte("tank/foo@msnap_daily-1997-01-17_1654\n" +
+		"tank/foo@msnap_manual-1997-01-18_1654_pre-upgrade_never\n" +
+		"tank/foo@msnap_hourly::1997-01-19T16:54:13Z\n")
+	want := []*snapobj.SnapObj{
+		{Type: snapobj.Daily, Epoch: time.Unix(853520040, 0).UTC()},
+		{Type: snapobj.Manual, Epoch: time.Unix(853606440, 0).UTC(), Label: "pre-upgrade"},
+		{Type: snapobj.Hourly, Epoch: time.Unix(853692853, 0).UTC(), Source: "msnap_hourly::1997-01-19T16:54:13Z"},
+	}
+	got, err := parseSnapshots("tank/foo@", nm, out)
+	if err != nil {
+		t.Fatalf("parseSnapshots() = _, %v, want nil err", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseSnapshots() mismatch (-want +got)\n%s", diff)
+	}
+
+	wantNames := []string{"msnap_daily-1997-01-17_1654", "msnap_manual-1997-01-18_1654_pre-upgrade_never", "msnap_hourly::1997-01-19T16:54:13Z"}
+	wantNative := []string{"msnap_daily-1997-01-17_1654", "msnap_manual-1997-01-18_1654_pre-upgrade_never", "msnap_hourly-1997-01-19_1654"}
+	for i, so := range got {
+		if n := nm.name(so); n != wantNames[i] {
+			t.Errorf("name(%s) = %s, want %s", so.FileName(), n, wantNames[i])
+		}
+		if n := nm.native(so); n != wantNative[i] {
+			t.Errorf("native(%s) = %s, want %s", so.FileName(), n, wantNative[i])
+		}
+	}
+}
+
+func TestMetaArgs(t *testing.T) {
+	meta := map[string]string{snapobj.MetaNote: "a note", snapobj.MetaCreator: "root"}
+	want := []string{"-o", "minisnap:creator=root", "-o", "minisnap:note=a note"}
+	if diff := cmp.Diff(want, metaArgs("-o", meta)); diff != "" {
+		t.Errorf("metaArgs() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestParseSnapshotsInvalid(t *testing.T) {
+	out := []byte("tank/foo@msnap_daily::yesterday\n")
+	if _, err := parseSnapshots("tank/foo@", naming{prefix: "msnap_"}, out); err == nil {
+		t.Errorf("parseSnapshots() = _, nil, want error")
+	}
+}
@@ -0,0 +1,120 @@
+// Package lock provides advisory locks backed by flock(2), which prevent concurrent runs of msnap
+// from racing on the same volume.
+//
+// Locks are released by the kernel once their holder exits, so lock files left behind after a
+// crash never block later runs. The file of a held lock records the pid of its holder.
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDir holds the lock files unless configured otherwise.
+const DefaultDir = "/run/minisnap"
+
+// pollInterval is the time between two attempts to acquire a busy lock.
+const pollInterval = 100 * time.Millisecond
+
+// Locker hands out locks backed by files within Dir.
+type Locker struct {
+	Dir string
+	// Timeout is the time to wait for a busy lock. Zero fails immediately, a negative timeout waits forever.
+	Timeout time.Duration
+}
+
+// Lock is a held lock.
+type Lock struct {
+	f *os.File
+}
+
+// BusyError is returned if a lock is still held by someone else once the timeout expired.
+type BusyError struct {
+	Name string
+	// Pid and Since describe the holder of the lock, Pid is 0 if unknown.
+	Pid   int
+	Since time.Time
+}
+
+func (e *BusyError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("'%s' is locked by another process", e.Name)
+	}
+	return fmt.Sprintf("'%s' is locked by pid %d since %s", e.Name, e.Pid, e.Since.Format(time.RFC3339))
+}
+
+// Lock acquires the exclusive lock called name, e.g. the path of a volume.
+func (l *Locker) Lock(name string) (*Lock, error) {
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(l.Dir, url.PathEscape(name)+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(l.Timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock '%s': %v", name, err)
+		}
+		if l.Timeout >= 0 && !time.Now().Before(deadline) {
+			be := &BusyError{Name: name}
+			be.Pid, be.Since = holder(f)
+			f.Close()
+			return nil, be
+		}
+		time.Sleep(pollInterval)
+	}
+
+	// Replace the record of the previous holder, which may have crashed.
+	rec := fmt.Sprintf("%d %s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(rec), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	l.f.Truncate(0)
+	return l.f.Close()
+}
+
+// holder returns the pid and acquisition time recorded in the lock file f.
+func holder(f *os.File) (int, time.Time) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, time.Time{}
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, time.Time{}
+	}
+	fl := strings.Fields(string(b))
+	if len(fl) != 2 {
+		return 0, time.Time{}
+	}
+	pid, err := strconv.Atoi(fl[0])
+	if err != nil {
+		return 0, time.Time{}
+	}
+	since, _ := time.Parse(time.RFC3339, fl[1])
+	return pid, since
+}
@@ -0,0 +1,80 @@
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := &Locker{Dir: filepath.Join(dir, "locks")}
+	a, err := l.Lock("/tank/foo")
+	if err != nil {
+		t.Fatalf("Lock() = _, %v, want nil err", err)
+	}
+
+	// flock locks belong to the open file, so a second lock conflicts even within this process.
+	start := time.Now()
+	l.Timeout = 3 * pollInterval
+	_, err = l.Lock("/tank/foo")
+	be, ok := err.(*BusyError)
+	if !ok {
+		t.Fatalf("Lock() of held lock = _, %v, want BusyError", err)
+	}
+	if be.Pid != os.Getpid() {
+		t.Errorf("BusyError.Pid = %d, want %d", be.Pid, os.Getpid())
+	}
+	if d := time.Since(start); d < l.Timeout {
+		t.Errorf("Lock() of held lock returned after %v, want at least %v", d, l.Timeout)
+	}
+
+	if _, err := l.Lock("/tank"); err != nil {
+		t.Errorf("Lock() of other name = _, %v, want nil err", err)
+	}
+
+	if err := a.Unlock(); err != nil {
+		t.Fatalf("Unlock() = %v, want nil", err)
+	}
+	b, err := l.Lock("/tank/foo")
+	if err != nil {
+		t.Fatalf("Lock() after Unlock() = _, %v, want nil err", err)
+	}
+	b.Unlock()
+}
+
+func TestStaleFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msnap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A record left behind by a crashed run does not block anyone.
+	path := filepath.Join(dir, "global.lock")
+	if err := ioutil.WriteFile(path, []byte("999999999 2020-01-02T00:00:00Z\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := &Locker{Dir: dir}
+	lk, err := l.Lock("global")
+	if err != nil {
+		t.Fatalf("Lock() with stale file = _, %v, want nil err", err)
+	}
+	defer lk.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if pid, _ := holder(f); pid != os.Getpid() {
+		t.Errorf("holder() = %d, want %d", pid, os.Getpid())
+	}
+}
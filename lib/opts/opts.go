@@ -2,5 +2,90 @@ package opts
 
 // VolOptions describes options important to the fs drivers.
 type VolOptions struct {
-	Recursive bool
+	Recursive bool `yaml:",omitempty"`
+	// Create read-only snapshots, required by 'btrfs send'.
+	ReadOnly bool `yaml:"readonly,omitempty"`
+	// Replicate snapshots of this volume, disabled if nil.
+	Replicate *Replicate `yaml:",omitempty"`
+	// Archive send streams of this volume, disabled if nil.
+	Archive *Archive `yaml:",omitempty"`
+	// Hooks enables snapshots from package manager hooks ('msnap hook'), disabled if nil.
+	Hooks *Hooks `yaml:",omitempty"`
+	// Adopt manages the snapshots of other tools like our own: 'zfs-auto-snapshot' and 'sanoid' on ZFS,
+	// 'snapper' on btrfs. 'msnap migrate' renames them into our format.
+	Adopt []string `yaml:",omitempty"`
+	// Naming is the template of snapshot names, e.g. '{type}-{2006-01-02_1504}'.
+	// Snapshots are named '<type>@<RFC 3339 time>' if empty.
+	Naming string `yaml:",omitempty"`
+}
+
+// Sends returns true if the volume options require send streams.
+func (o VolOptions) Sends() bool {
+	return o.Replicate != nil || o.Archive != nil
+}
+
+// Hooks describes the snapshots taken by package manager hooks.
+type Hooks struct {
+	// Keep is the number of pre/post snapshot pairs kept per tool, all are kept if 0.
+	Keep int `yaml:",omitempty"`
+}
+
+// Replicate describes the destination of a replicated volume.
+type Replicate struct {
+	// Target is either a local dataset (or directory) or a ssh://[user@]host[:port]/path URL.
+	Target string
+	// SSHCommand is the ssh binary used to reach remote targets.
+	SSHCommand string `yaml:"ssh_command,omitempty"`
+	// SSHOptions are passed to ssh, e.g. ["-i", "/root/.ssh/id_backup"].
+	SSHOptions []string `yaml:"ssh_options,omitempty"`
+	// Compress the stream in transit using 'zstd' or 'lz4'.
+	Compress string `yaml:",omitempty"`
+	// Buffer is the size of the in-process buffer between sender and receiver, e.g. '128M'.
+	Buffer string `yaml:",omitempty"`
+	// Bookmarks is the number of bookmarks of replicated snapshots to keep, 0 disables bookmarks.
+	Bookmarks int `yaml:",omitempty"`
+	// RateLimit caps the throughput in bytes per second, e.g. '10M'. Unlimited if empty.
+	RateLimit string `yaml:"rate_limit,omitempty"`
+	// RateSchedule overrides RateLimit during the given times of day.
+	RateSchedule []RateWindow `yaml:"rate_schedule,omitempty"`
+}
+
+// RateWindow limits the throughput during a time of day, e.g. from '08:00' to '18:00'.
+type RateWindow struct {
+	From  string
+	To    string
+	Limit string
+}
+
+// Archive describes where and how send streams of a volume are archived.
+type Archive struct {
+	// Dir is the directory receiving the stream files and the manifest.
+	Dir string `yaml:",omitempty"`
+	// S3 stores the streams in a bucket instead of Dir.
+	S3 *S3 `yaml:",omitempty"`
+	// Compress the stream files using 'zstd' or 'lz4'.
+	Compress string `yaml:",omitempty"`
+	// FullEvery starts a new full stream after this many incremental streams, 0 never does.
+	FullEvery int `yaml:"full_every,omitempty"`
+	// Types restricts archiving to the given snapshot types, all types are archived if empty.
+	Types []string `yaml:",omitempty"`
+}
+
+// S3 describes a bucket of an S3-compatible object store.
+type S3 struct {
+	// Endpoint is the URL of the object store, e.g. 'http://localhost:9000'.
+	Endpoint string
+	Region   string `yaml:",omitempty"`
+	Bucket   string
+	// Prefix is prepended to all object names.
+	Prefix string `yaml:",omitempty"`
+	// AccessKey and SecretKey default to $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY.
+	AccessKey string `yaml:"access_key,omitempty"`
+	SecretKey string `yaml:"secret_key,omitempty"`
+	// PartSize is the size of a single part of a multipart upload, e.g. '64M'.
+	PartSize string `yaml:"part_size,omitempty"`
+	// EncryptionKeyFile holds a 256 bit key used to encrypt all objects, disabled if empty.
+	EncryptionKeyFile string `yaml:"encryption_key_file,omitempty"`
+	// StateDir keeps track of interrupted uploads, so they can be resumed.
+	StateDir string `yaml:"state_dir,omitempty"`
 }
@@ -19,12 +19,40 @@ type Plan struct {
 	Target *snapobj.SnapObj
 }
 
+// Plan returns the snapshots to create and delete. Deletions assume that all creations succeed.
 func (p Policy) Plan(s []*snapobj.SnapObj) ([]*Plan, error) {
+	return p.plan(s, true)
+}
+
+// Prune returns the snapshots to delete if no snapshots are created. Unlike the deletions
+// returned by Plan, these do not rely on due snapshots replacing the deleted ones.
+func (p Policy) Prune(s []*snapobj.SnapObj) ([]*Plan, error) {
+	return p.plan(s, false)
+}
+
+// Creations returns the creations of pl, dropping all deletions.
+func Creations(pl []*Plan) []*Plan {
+	cr := make([]*Plan, 0)
+	for _, o := range pl {
+		if !o.Delete {
+			cr = append(cr, o)
+		}
+	}
+	return cr
+}
+
+func (p Policy) plan(s []*snapobj.SnapObj, create bool) ([]*Plan, error) {
 	pl := make([]*Plan, 0)
 	catalog := make(map[snapobj.Type][]*snapobj.SnapObj)
+	var manual []*snapobj.SnapObj
 
 	// First, separate all snapshots by type and sort them by time.
+	// Manual snapshots do not count towards any type and are only deleted once they expire.
 	for _, o := range s {
+		if o.Type == snapobj.Manual {
+			manual = append(manual, o)
+			continue
+		}
 		catalog[o.Type] = append(catalog[o.Type], o)
 	}
 	for _, o := range catalog {
@@ -33,6 +61,10 @@ func (p Policy) Plan(s []*snapobj.SnapObj) ([]*Plan, error) {
 
 	// Second: check all types to see if we need to create a new snapshot.
 	for t := range p.Keep {
+		if !create {
+			// pruning only: nothing gets created, so nothing can be replaced either.
+			break
+		}
 		if p.Keep[t] < 1 {
 			// skip as there should be no snapshots of this type.
 			continue
@@ -67,5 +99,47 @@ func (p Policy) Plan(s []*snapobj.SnapObj) ([]*Plan, error) {
 			}
 		}
 	}
+
+	sort.Sort(bySnap(manual))
+	for _, x := range manual {
+		if !x.Expires.IsZero() && !x.Expires.After(p.Now) {
+			pl = append(pl, &Plan{Delete: true, Target: x})
+		}
+	}
 	return pl, nil
 }
+
+// Next returns the time at which Plan will create the next snapshot, which is Now if one is due already.
+// The zero time is returned if the policy does not keep any snapshots.
+func (p Policy) Next(s []*snapobj.SnapObj) time.Time {
+	var next time.Time
+	for t, k := range p.Keep {
+		if k < 1 {
+			continue
+		}
+		due := p.Now
+		for _, x := range s {
+			if exp := x.Epoch.Add(time.Duration(t) * time.Second); x.Type == t && exp.After(due) {
+				due = exp
+			}
+		}
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	return next
+}
+
+// Expiry returns the estimated time at which s will be deleted, assuming snapshots keep being
+// created on schedule. Snapshots of types without a positive keep count expire once they are no longer current.
+// Manual snapshots expire at the time they carry, the zero time if they are kept forever.
+func (p Policy) Expiry(s *snapobj.SnapObj) time.Time {
+	if s.Type == snapobj.Manual {
+		return s.Expires
+	}
+	k := p.Keep[s.Type]
+	if k < 1 {
+		k = 1
+	}
+	return s.Epoch.Add(time.Duration(k) * time.Duration(s.Type) * time.Second)
+}
@@ -277,6 +277,35 @@ func TestPlan(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "manual snapshots",
+			policy: &Policy{
+				Now: now,
+				Keep: map[snapobj.Type]int{
+					snapobj.Hourly: 1,
+				},
+			},
+			input: []*snapobj.SnapObj{
+				sof("manual@1972-11-07T15:54:13Z@pre-upgrade@1972-11-07T16:54:13Z"), // not yet expired.
+				sof("manual@1972-11-07T00:54:13Z@forever"),
+				sof("manual@1972-11-06T00:54:13Z@pre-upgrade@1972-11-07T00:54:13Z"),
+				sof("hourly@1972-11-07T00:54:13Z"),
+			},
+			want: []*Plan{
+				{
+					Delete: false,
+					Target: sof("hourly@1972-11-07T16:02:03Z"),
+				},
+				{
+					Delete: true,
+					Target: sof("hourly@1972-11-07T00:54:13Z"),
+				},
+				{
+					Delete: true,
+					Target: sof("manual@1972-11-06T00:54:13Z@pre-upgrade@1972-11-07T00:54:13Z"),
+				},
+			},
+		},
 		{
 			name: "simple swap",
 			policy: &Policy{
@@ -311,3 +340,215 @@ func TestPlan(t *testing.T) {
 		}
 	}
 }
+
+func TestPrune(t *testing.T) {
+	sof := func(s string) *snapobj.SnapObj {
+		v, err := snapobj.FromString(s)
+		if err != nil {
+			panic(err)
+		}
+		return v
+	}
+
+	now := time.Unix(90000123, 0).UTC()
+
+	input := []struct {
+		name   string
+		policy *Policy
+		input  []*snapobj.SnapObj
+		want   []*Plan
+	}{
+		{
+			name: "nothing due",
+			policy: &Policy{
+				Now: now,
+				Keep: map[snapobj.Type]int{
+					snapobj.Hourly: 1,
+				},
+			},
+			input: []*snapobj.SnapObj{},
+			want:  []*Plan{},
+		},
+		{
+			name: "keep expired until replaced",
+			policy: &Policy{
+				Now: now,
+				Keep: map[snapobj.Type]int{
+					snapobj.Hourly: 1,
+				},
+			},
+			input: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T00:54:13Z"),
+			},
+			want: []*Plan{},
+		},
+		{
+			name: "excess",
+			policy: &Policy{
+				Now: now,
+				Keep: map[snapobj.Type]int{
+					snapobj.Hourly: 2,
+				},
+			},
+			input: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T00:54:13Z"),
+				sof("hourly@1972-11-07T01:54:13Z"),
+				sof("hourly@1972-11-07T02:54:13Z"),
+			},
+			want: []*Plan{
+				{
+					Delete: true,
+					Target: sof("hourly@1972-11-07T00:54:13Z"),
+				},
+			},
+		},
+		{
+			name: "expired manual",
+			policy: &Policy{
+				Now: now,
+				Keep: map[snapobj.Type]int{
+					snapobj.Hourly: 1,
+				},
+			},
+			input: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T00:54:13Z"),
+				sof("manual@1972-11-06T00:54:13Z@pre-upgrade@1972-11-07T00:54:13Z"),
+			},
+			want: []*Plan{
+				{
+					Delete: true,
+					Target: sof("manual@1972-11-06T00:54:13Z@pre-upgrade@1972-11-07T00:54:13Z"),
+				},
+			},
+		},
+		{
+			name: "dropped type",
+			policy: &Policy{
+				Now:  now,
+				Keep: map[snapobj.Type]int{},
+			},
+			input: []*snapobj.SnapObj{
+				sof("daily@1972-11-05T00:54:13Z"),
+			},
+			want: []*Plan{
+				{
+					Delete: true,
+					Target: sof("daily@1972-11-05T00:54:13Z"),
+				},
+			},
+		},
+	}
+
+	for _, tt := range input {
+		got, err := tt.policy.Prune(tt.input)
+		if err != nil {
+			t.Errorf("Prune(%s) = _, %v, want nil err", tt.name, err)
+		}
+		if diff := cmp.Diff(got, tt.want); diff != "" {
+			t.Errorf("Prune(%s) mismatch (-want +got)\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestCreations(t *testing.T) {
+	c := &Plan{Target: &snapobj.SnapObj{Type: snapobj.Hourly}}
+	d := &Plan{Delete: true, Target: &snapobj.SnapObj{Type: snapobj.Daily}}
+
+	got := Creations([]*Plan{d, c, d})
+	if diff := cmp.Diff([]*Plan{c}, got); diff != "" {
+		t.Errorf("Creations() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+func TestNext(t *testing.T) {
+	now := time.Unix(90000123, 0).UTC()
+	snap := func(t snapobj.Type, ago time.Duration) *snapobj.SnapObj {
+		return &snapobj.SnapObj{Type: t, Epoch: now.Add(-ago)}
+	}
+
+	input := []struct {
+		name  string
+		keep  map[snapobj.Type]int
+		input []*snapobj.SnapObj
+		want  time.Time
+	}{
+		{
+			name: "nothing kept",
+			keep: map[snapobj.Type]int{snapobj.Hourly: 0},
+			want: time.Time{},
+		},
+		{
+			name: "due",
+			keep: map[snapobj.Type]int{snapobj.Hourly: 1, snapobj.Daily: 1},
+			input: []*snapobj.SnapObj{
+				snap(snapobj.Daily, time.Hour),
+			},
+			want: now,
+		},
+		{
+			name: "earliest type",
+			keep: map[snapobj.Type]int{snapobj.Hourly: 1, snapobj.Daily: 1},
+			input: []*snapobj.SnapObj{
+				snap(snapobj.Hourly, 10*time.Minute),
+				snap(snapobj.Hourly, 70*time.Minute),
+				snap(snapobj.Daily, 2*time.Hour),
+			},
+			want: now.Add(50 * time.Minute),
+		},
+		{
+			name: "ignores other types",
+			keep: map[snapobj.Type]int{snapobj.Daily: 1},
+			input: []*snapobj.SnapObj{
+				snap(snapobj.Hourly, 10*time.Minute),
+				snap(snapobj.Daily, 2*time.Hour),
+			},
+			want: now.Add(22 * time.Hour),
+		},
+	}
+
+	for _, tt := range input {
+		p := &Policy{Now: now, Keep: tt.keep}
+		if got := p.Next(tt.input); !got.Equal(tt.want) {
+			t.Errorf("Next(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	p := &Policy{
+		Keep: map[snapobj.Type]int{
+			snapobj.Hourly: 24,
+			snapobj.Daily:  0,
+		},
+	}
+	input := []struct {
+		snap *snapobj.SnapObj
+		want time.Time
+	}{
+		{
+			snap: &snapobj.SnapObj{Type: snapobj.Hourly, Epoch: time.Unix(0, 0)},
+			want: time.Unix(86400, 0),
+		},
+		{
+			snap: &snapobj.SnapObj{Type: snapobj.Daily, Epoch: time.Unix(0, 0)},
+			want: time.Unix(86400, 0),
+		},
+		{
+			snap: &snapobj.SnapObj{Type: snapobj.Weekly, Epoch: time.Unix(60, 0)},
+			want: time.Unix(60+86400*7, 0),
+		},
+		{
+			snap: &snapobj.SnapObj{Type: snapobj.Manual, Epoch: time.Unix(60, 0), Expires: time.Unix(120, 0)},
+			want: time.Unix(120, 0),
+		},
+		{
+			snap: &snapobj.SnapObj{Type: snapobj.Manual, Epoch: time.Unix(60, 0)},
+		},
+	}
+
+	for _, tt := range input {
+		if got := p.Expiry(tt.snap); !got.Equal(tt.want) {
+			t.Errorf("Expiry(%v) = %v, want %v", tt.snap, got, tt.want)
+		}
+	}
+}
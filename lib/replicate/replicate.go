@@ -0,0 +1,458 @@
+package replicate
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/adrian-bl/minisnap/lib/fs"
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/opts"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+	"github.com/adrian-bl/minisnap/lib/stream"
+)
+
+type Replicator struct {
+	src      fs.Sender
+	recv     fs.Receiver
+	target   *Target
+	exec     *exec.Exec
+	compress string
+	buffer   int64
+	// Template of the local snapshot names, nil for the legacy format.
+	naming *snapobj.Template
+	// Number of bookmarks to keep, 0 if disabled.
+	bookmarks int
+	// Throughput limit, nil if unlimited.
+	rates  *stream.RateSchedule
+	report func(Progress)
+}
+
+// progressInterval is the time between two progress reports.
+const progressInterval = 2 * time.Second
+
+// Progress describes a running transfer.
+type Progress struct {
+	Target   string
+	Snapshot string
+	stream.Stats
+}
+
+// Step describes a single stream to be sent.
+type Step struct {
+	// Base of an incremental stream, nil for a full stream.
+	Base *snapobj.SnapObj
+	Snap *snapobj.SnapObj
+	// FromBookmark is set if Base only exists as a bookmark.
+	FromBookmark bool
+}
+
+func New(src fs.Sender, ro *opts.Replicate, e *exec.Exec) (*Replicator, error) {
+	t, err := ParseTarget(ro.Target)
+	if err != nil {
+		return nil, err
+	}
+	if t.Remote != nil {
+		t.Remote.Command = ro.SSHCommand
+		t.Remote.Options = ro.SSHOptions
+	}
+
+	// The target receives the snapshots under their local names.
+	var tmpl *snapobj.Template
+	if n, ok := src.(fs.Namer); ok {
+		tmpl = n.Naming()
+	}
+	recv, err := fs.NewReceiver(src.Kind(), tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := exec.Compressors[ro.Compress]; !ok && ro.Compress != "" {
+		return nil, fmt.Errorf("unknown compression '%s'", ro.Compress)
+	}
+
+	if _, ok := src.(fs.Bookmarker); !ok && ro.Bookmarks > 0 {
+		return nil, fmt.Errorf("%s does not support bookmarks", src.Description())
+	}
+	if ro.Bookmarks < 0 {
+		return nil, fmt.Errorf("bookmarks must not be negative")
+	}
+
+	var buffer int64
+	if ro.Buffer != "" {
+		if buffer, err = stream.ParseSize(ro.Buffer); err != nil {
+			return nil, err
+		}
+	}
+
+	var rates *stream.RateSchedule
+	if ro.RateLimit != "" || len(ro.RateSchedule) > 0 {
+		rates = &stream.RateSchedule{}
+		if ro.RateLimit != "" {
+			if rates.Default, err = stream.ParseSize(ro.RateLimit); err != nil {
+				return nil, err
+			}
+		}
+		for _, w := range ro.RateSchedule {
+			rw, err := stream.ParseRateWindow(w.From, w.To, w.Limit)
+			if err != nil {
+				return nil, fmt.Errorf("rate_schedule: %v", err)
+			}
+			rates.Windows = append(rates.Windows, rw)
+		}
+	}
+
+	r := &Replicator{
+		src:       src,
+		naming:    tmpl,
+		recv:      recv,
+		target:    t,
+		exec:      e,
+		compress:  ro.Compress,
+		buffer:    buffer,
+		bookmarks: ro.Bookmarks,
+		rates:     rates,
+	}
+	return r, nil
+}
+
+// SetReporter installs a function receiving periodic progress reports of all transfers.
+func (r *Replicator) SetReporter(fn func(Progress)) {
+	r.report = fn
+}
+
+// Status describes the state of a replica.
+type Status struct {
+	Target string
+	// Latest is the newest snapshot present on both sides, empty if there is none.
+	Latest string
+	// Pending is the number of streams required to bring the target up to date.
+	Pending int
+	// ResumeToken describes an interrupted stream, empty if there is none.
+	ResumeToken string
+}
+
+// Status returns the current state of the target.
+func (r *Replicator) Status() (*Status, error) {
+	local, err := r.src.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather local snapshots: %v", err)
+	}
+	remote, err := r.remote()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather snapshots of %s: %v", r.target, err)
+	}
+	marks, err := r.marks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather bookmarks: %v", err)
+	}
+
+	st := &Status{
+		Target:      r.target.String(),
+		Pending:     len(Steps(local, remote, marks, r.naming)),
+		ResumeToken: r.resumeToken(),
+	}
+	have := keys(r.naming, remote)
+	for _, o := range sorted(local) {
+		if have[key(r.naming, o)] {
+			st.Latest = o.FileName()
+		}
+	}
+	return st, nil
+}
+
+// Run sends all snapshots missing on the target, continuing an interrupted stream first.
+func (r *Replicator) Run() error {
+	if token := r.resumeToken(); token != "" {
+		scmd := r.recv.(fs.Resumer).Resume(token)
+		total := r.estimate(scmd)
+		r.exec.Printf("Resuming interrupted stream to %s%s\n", r.target, formatEstimate(total))
+		if err := r.transfer(scmd, "resumed stream", total); err != nil {
+			return fmt.Errorf("failed to resume stream to %s: %v", r.target, err)
+		}
+	}
+
+	local, err := r.src.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather local snapshots: %v", err)
+	}
+	remote, err := r.remote()
+	if err != nil {
+		return fmt.Errorf("failed to gather snapshots of %s: %v", r.target, err)
+	}
+	marks, err := r.marks()
+	if err != nil {
+		return fmt.Errorf("failed to gather bookmarks: %v", err)
+	}
+
+	replicated := keys(r.naming, remote)
+	steps := Steps(local, remote, marks, r.naming)
+	if len(steps) == 0 {
+		r.exec.Printf("Replica %s is up to date\n", r.target)
+	}
+	for _, s := range steps {
+		if err := r.send(s); err != nil {
+			return fmt.Errorf("failed to send %s to %s: %v", s.Snap.FileName(), r.target, err)
+		}
+		replicated[key(r.naming, s.Snap)] = true
+	}
+
+	if r.bookmarks > 0 {
+		if err := r.updateBookmarks(local, marks, replicated); err != nil {
+			return fmt.Errorf("failed to update bookmarks: %v", err)
+		}
+	}
+	return nil
+}
+
+// marks returns the existing bookmarks, if enabled.
+func (r *Replicator) marks() ([]*snapobj.SnapObj, error) {
+	if r.bookmarks == 0 {
+		return nil, nil
+	}
+	return r.src.(fs.Bookmarker).Bookmarks()
+}
+
+// updateBookmarks bookmarks the newest replicated snapshots and removes all but the newest bookmarks.
+func (r *Replicator) updateBookmarks(local, marks []*snapobj.SnapObj, replicated map[string]bool) error {
+	bm := r.src.(fs.Bookmarker)
+	have := make(map[string]bool)
+	for _, o := range marks {
+		have[key(r.naming, o)] = true
+	}
+
+	l := sorted(local)
+	all := append([]*snapobj.SnapObj{}, marks...)
+	for i, n := len(l)-1, 0; i >= 0 && n < r.bookmarks; i-- {
+		if !replicated[key(r.naming, l[i])] {
+			continue
+		}
+		n++
+		if have[key(r.naming, l[i])] {
+			continue
+		}
+		if err := bm.Bookmark(l[i]); err != nil {
+			return err
+		}
+		all = append(all, l[i])
+	}
+
+	all = sorted(all)
+	for i := 0; i < len(all)-r.bookmarks; i++ {
+		if err := bm.DeleteBookmark(all[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remote returns the snapshots present on the target.
+func (r *Replicator) remote() ([]*snapobj.SnapObj, error) {
+	out, err := r.exec.Query(r.target.Remote.Wrap(r.recv.List(r.target.Path)))
+	// The target usually does not exist before the initial replication. Any other failure, e.g. of ssh,
+	// must not be mistaken for an empty target, which would be overwritten by a full stream.
+	if qe, ok := err.(*exec.QueryError); ok && r.recv.Missing(qe.Stderr) {
+		r.exec.Printf("%s does not exist yet\n", r.target)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.recv.Parse(r.target.Path, out)
+}
+
+// resumeToken returns the token of an interrupted stream to the target, empty if there is none
+// or the receiver does not support resuming.
+func (r *Replicator) resumeToken() string {
+	rs, ok := r.recv.(fs.Resumer)
+	if !ok {
+		return ""
+	}
+	out, err := r.exec.Output(r.target.Remote.Wrap(rs.ResumeToken(r.target.Path)))
+	if err != nil {
+		// Most likely the target does not exist yet.
+		return ""
+	}
+	return rs.ParseResumeToken(out)
+}
+
+// send transfers a single stream to the target.
+func (r *Replicator) send(s Step) error {
+	scmd := r.src.Send(s.Base, s.Snap)
+	if s.FromBookmark {
+		scmd = r.src.(fs.Bookmarker).SendFromBookmark(s.Base, s.Snap)
+	}
+	total := r.estimate(scmd)
+
+	switch {
+	case s.Base == nil:
+		r.exec.Printf("Sending %s to %s%s\n", s.Snap.FileName(), r.target, formatEstimate(total))
+	case s.FromBookmark:
+		r.exec.Printf("Sending %s to %s, incremental from bookmark %s%s\n", s.Snap.FileName(), r.target, s.Base.FileName(), formatEstimate(total))
+	default:
+		r.exec.Printf("Sending %s to %s, incremental from %s%s\n", s.Snap.FileName(), r.target, s.Base.FileName(), formatEstimate(total))
+	}
+	return r.transfer(scmd, s.Snap.FileName(), total)
+}
+
+// estimate returns the expected size of the stream produced by scmd, 0 if unknown.
+func (r *Replicator) estimate(scmd exec.Cmd) int64 {
+	est, ok := r.src.(fs.Estimator)
+	if !ok {
+		return 0
+	}
+	ecmd, ok := est.Estimate(scmd)
+	if !ok {
+		return 0
+	}
+	out, err := r.exec.Output([]exec.Cmd{ecmd})
+	if err != nil {
+		return 0
+	}
+	n, err := est.ParseEstimate(out)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// formatEstimate returns a suffix describing the expected size, if known.
+func formatEstimate(n int64) string {
+	if n <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (~%s)", stream.FormatSize(n))
+}
+
+// transfer pipes the output of the send command scmd into the receiver.
+// name identifies the transfer in progress reports.
+func (r *Replicator) transfer(scmd exec.Cmd, name string, total int64) error {
+	src := []exec.Cmd{scmd}
+	dst := []exec.Cmd{r.recv.Receive(r.target.Path)}
+	if c, ok := exec.Compressors[r.compress]; ok {
+		src = append(src, c.Compress)
+		dst = append([]exec.Cmd{c.Decompress}, dst...)
+	}
+
+	report := func(st stream.Stats) {
+		if r.report != nil {
+			r.report(Progress{Target: r.target.String(), Snapshot: name, Stats: st})
+		}
+	}
+
+	var prog *stream.Progress
+	filter := func(rd io.Reader) io.Reader {
+		var closer io.Closer
+		if r.buffer > 0 {
+			b := stream.NewBuffer(rd, r.buffer)
+			rd, closer = b, b
+		}
+		if r.rates != nil {
+			rd = stream.NewLimiter(rd, r.rates.Rate)
+		}
+		prog = stream.NewProgress(rd, total, progressInterval, report)
+		if closer != nil {
+			return readCloser{Reader: prog, Closer: closer}
+		}
+		return prog
+	}
+
+	if err := r.exec.Pipe(src, filter, r.target.Remote.Wrap(dst...)); err != nil {
+		return err
+	}
+	if prog != nil {
+		st := prog.Stats()
+		r.exec.Printf("Sent %s\n", st)
+		report(st)
+	}
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Steps returns the streams required to bring remote up to date with local.
+// Replication continues from the newest snapshot both sides have in common, which may only
+// exist as a bookmark locally. Without such a snapshot, replication starts with a full stream
+// of the oldest local snapshot. Adopted snapshots are never sent, as the target would not recognize
+// their foreign names, but those named before tmpl was set remain usable as base.
+// Snapshots are matched using key, so replicas keep their names when the local ones are migrated.
+func Steps(local, remote, bookmarks []*snapobj.SnapObj, tmpl *snapobj.Template) []Step {
+	have := keys(tmpl, remote)
+
+	var base *snapobj.SnapObj
+	var fromBookmark bool
+	l := make([]*snapobj.SnapObj, 0, len(local))
+	for _, o := range sorted(local) {
+		if have[key(tmpl, o)] {
+			base = o
+		}
+		if !o.Adopted() {
+			l = append(l, o)
+		}
+	}
+	for _, o := range bookmarks {
+		if have[key(tmpl, o)] && (base == nil || less(base, o)) {
+			base, fromBookmark = o, true
+		}
+	}
+
+	steps := make([]Step, 0)
+	if base == nil {
+		if len(l) == 0 {
+			return steps
+		}
+		steps = append(steps, Step{Snap: l[0]})
+		base = l[0]
+	}
+	for _, o := range l {
+		if !less(base, o) {
+			continue
+		}
+		steps = append(steps, Step{Base: base, Snap: o, FromBookmark: fromBookmark})
+		base, fromBookmark = o, false
+	}
+	return steps
+}
+
+// key identifies s when comparing local snapshots with those of the target. Adopted snapshots are identified
+// by their name, which only the target's copies of snapshots named before tmpl was set share. Other snapshots
+// are identified by the name tmpl gives them, which ignores the precision lost when migrating their names.
+func key(tmpl *snapobj.Template, s *snapobj.SnapObj) string {
+	if s.Adopted() {
+		return s.Source
+	}
+	return tmpl.Format(s)
+}
+
+// keys returns the keys matching the snapshots of the target. Copies of snapshots named before tmpl was set
+// match both their local original and its migrated version.
+func keys(tmpl *snapobj.Template, remote []*snapobj.SnapObj) map[string]bool {
+	have := make(map[string]bool)
+	for _, o := range remote {
+		have[key(tmpl, o)] = true
+		have[tmpl.Format(o)] = true
+	}
+	return have
+}
+
+// less returns true if a is older than b, using the name to order snapshots of the same age.
+func less(a, b *snapobj.SnapObj) bool {
+	if a.Epoch.Equal(b.Epoch) {
+		return a.FileName() < b.FileName()
+	}
+	return a.Epoch.Before(b.Epoch)
+}
+
+// sorted returns a copy of s, sorted by age.
+func sorted(s []*snapobj.SnapObj) []*snapobj.SnapObj {
+	l := make([]*snapobj.SnapObj, len(s))
+	copy(l, s)
+	sort.Slice(l, func(i, j int) bool {
+		return less(l[i], l[j])
+	})
+	return l
+}
@@ -0,0 +1,536 @@
+package replicate
+
+import (
+	"io/ioutil"
+	"os"
+	oe "os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+	"github.com/adrian-bl/minisnap/lib/snapobj"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func sof(s string) *snapobj.SnapObj {
+	v, err := snapobj.FromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// legacy returns the snapshot s as parsed on a volume whose naming template was set after s was taken.
+func legacy(s string) *snapobj.SnapObj {
+	so := sof(s)
+	so.Source = "msnap_" + strings.Replace(s, "@", "::", -1)
+	return so
+}
+
+// named returns the snapshot named n by tmpl.
+func named(tmpl *snapobj.Template, n string) *snapobj.SnapObj {
+	so, err := tmpl.Parse(n)
+	if err != nil {
+		panic(err)
+	}
+	return so
+}
+
+func TestSteps(t *testing.T) {
+	minutes, err := snapobj.ParseTemplate("{type}-{2006-01-02_1504}")
+	if err != nil {
+		t.Fatalf("ParseTemplate() = _, %v, want nil", err)
+	}
+
+	input := []struct {
+		name      string
+		local     []*snapobj.SnapObj
+		remote    []*snapobj.SnapObj
+		bookmarks []*snapobj.SnapObj
+		tmpl      *snapobj.Template
+		want      []Step
+	}{
+		{
+			name: "empty",
+			want: []Step{},
+		},
+		{
+			name: "initial",
+			local: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T16:00:00Z"),
+				sof("daily@1972-11-07T10:00:00Z"),
+			},
+			want: []Step{
+				{Snap: sof("daily@1972-11-07T10:00:00Z")},
+				{Base: sof("daily@1972-11-07T10:00:00Z"), Snap: sof("hourly@1972-11-07T16:00:00Z")},
+			},
+		},
+		{
+			name: "up to date",
+			local: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			remote: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T15:00:00Z"),
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			want: []Step{},
+		},
+		{
+			name: "incremental from newest common",
+			local: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T17:00:00Z"),
+				sof("hourly@1972-11-07T15:00:00Z"),
+				sof("hourly@1972-11-07T16:00:00Z"),
+				sof("hourly@1972-11-07T14:00:00Z"),
+			},
+			remote: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T14:00:00Z"),
+				sof("hourly@1972-11-07T15:00:00Z"),
+			},
+			want: []Step{
+				{Base: sof("hourly@1972-11-07T15:00:00Z"), Snap: sof("hourly@1972-11-07T16:00:00Z")},
+				{Base: sof("hourly@1972-11-07T16:00:00Z"), Snap: sof("hourly@1972-11-07T17:00:00Z")},
+			},
+		},
+		{
+			name: "same epoch",
+			local: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T16:00:00Z"),
+				sof("daily@1972-11-07T16:00:00Z"),
+			},
+			remote: []*snapobj.SnapObj{
+				sof("daily@1972-11-07T16:00:00Z"),
+			},
+			want: []Step{
+				{Base: sof("daily@1972-11-07T16:00:00Z"), Snap: sof("hourly@1972-11-07T16:00:00Z")},
+			},
+		},
+		{
+			name: "from bookmark",
+			local: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T17:00:00Z"),
+				sof("hourly@1972-11-07T18:00:00Z"),
+			},
+			remote: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T15:00:00Z"),
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			bookmarks: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T15:00:00Z"),
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			want: []Step{
+				{Base: sof("hourly@1972-11-07T16:00:00Z"), Snap: sof("hourly@1972-11-07T17:00:00Z"), FromBookmark: true},
+				{Base: sof("hourly@1972-11-07T17:00:00Z"), Snap: sof("hourly@1972-11-07T18:00:00Z")},
+			},
+		},
+		{
+			name: "prefer snapshot over bookmark",
+			local: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T16:00:00Z"),
+				sof("hourly@1972-11-07T17:00:00Z"),
+			},
+			remote: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T15:00:00Z"),
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			bookmarks: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T15:00:00Z"),
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			want: []Step{
+				{Base: sof("hourly@1972-11-07T16:00:00Z"), Snap: sof("hourly@1972-11-07T17:00:00Z")},
+			},
+		},
+		{
+			name: "bookmark unknown to remote",
+			local: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T17:00:00Z"),
+			},
+			remote: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T15:00:00Z"),
+			},
+			bookmarks: []*snapobj.SnapObj{
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			want: []Step{
+				{Snap: sof("hourly@1972-11-07T17:00:00Z")},
+			},
+		},
+		{
+			name: "skip adopted",
+			local: []*snapobj.SnapObj{
+				{Type: snapobj.Hourly, Epoch: sof("hourly@1972-11-07T15:00:00Z").Epoch, Source: "autosnap_1972-11-07_15:00:00_hourly"},
+				sof("hourly@1972-11-07T16:00:00Z"),
+			},
+			want: []Step{
+				{Snap: sof("hourly@1972-11-07T16:00:00Z")},
+			},
+		},
+		{
+			name: "naming enabled on replicated volume",
+			local: []*snapobj.SnapObj{
+				legacy("hourly@1972-11-07T15:00:13Z"),
+				named(minutes, "hourly-1972-11-07_1600"),
+			},
+			remote: []*snapobj.SnapObj{
+				legacy("hourly@1972-11-07T14:00:07Z"),
+				legacy("hourly@1972-11-07T15:00:13Z"),
+			},
+			tmpl: minutes,
+			want: []Step{
+				{Base: legacy("hourly@1972-11-07T15:00:13Z"), Snap: named(minutes, "hourly-1972-11-07_1600")},
+			},
+		},
+		{
+			name: "migrated replicated volume",
+			local: []*snapobj.SnapObj{
+				named(minutes, "hourly-1972-11-07_1400"),
+				named(minutes, "hourly-1972-11-07_1500"),
+				named(minutes, "hourly-1972-11-07_1600"),
+			},
+			remote: []*snapobj.SnapObj{
+				legacy("hourly@1972-11-07T14:00:07Z"),
+				legacy("hourly@1972-11-07T15:00:13Z"),
+			},
+			tmpl: minutes,
+			want: []Step{
+				{Base: named(minutes, "hourly-1972-11-07_1500"), Snap: named(minutes, "hourly-1972-11-07_1600")},
+			},
+		},
+		{
+			name: "foreign snapshot is no base",
+			local: []*snapobj.SnapObj{
+				{Type: snapobj.Hourly, Epoch: sof("hourly@1972-11-07T15:00:00Z").Epoch, Source: "autosnap_1972-11-07_15:00:00_hourly"},
+				named(minutes, "hourly-1972-11-07_1600"),
+			},
+			remote: []*snapobj.SnapObj{
+				named(minutes, "hourly-1972-11-07_1500"),
+			},
+			tmpl: minutes,
+			want: []Step{
+				{Snap: named(minutes, "hourly-1972-11-07_1600")},
+			},
+		},
+	}
+
+	for _, tt := range input {
+		got := Steps(tt.local, tt.remote, tt.bookmarks, tt.tmpl)
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("Steps(%s) mismatch (-want +got)\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	input := []struct {
+		input   string
+		want    *Target
+		wantErr bool
+	}{
+		{
+			input: "backup/tank",
+			want:  &Target{Path: "backup/tank"},
+		},
+		{
+			input: "ssh://root@nas:2222/backup/tank",
+			want: &Target{
+				Remote: &exec.Remote{Host: "nas", User: "root", Port: "2222"},
+				Path:   "backup/tank",
+			},
+		},
+		{
+			input: "ssh://nas//mnt/backup",
+			want: &Target{
+				Remote: &exec.Remote{Host: "nas"},
+				Path:   "/mnt/backup",
+			},
+		},
+		{
+			input:   "ssh://nas/",
+			wantErr: true,
+		},
+		{
+			input:   "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range input {
+		got, err := ParseTarget(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseTarget(%s) = _, nil, wanted err", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTarget(%s) = _, %v, wanted nil", tt.input, err)
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("ParseTarget(%s) mismatch (-want +got)\n%s", tt.input, diff)
+		}
+	}
+}
+
+// fakeSender emits the snapshot name as stream.
+type fakeSender struct {
+	snaps []*snapobj.SnapObj
+}
+
+func (f *fakeSender) Description() string                 { return "fake" }
+func (f *fakeSender) Gather() ([]*snapobj.SnapObj, error) { return f.snaps, nil }
+func (f *fakeSender) Create(*snapobj.SnapObj) error       { return nil }
+func (f *fakeSender) Delete(*snapobj.SnapObj) error       { return nil }
+func (f *fakeSender) Kind() string                        { return "fake" }
+func (f *fakeSender) Send(base, s *snapobj.SnapObj) exec.Cmd {
+	return exec.Cmd{Name: "echo", Args: []string{s.FileName()}}
+}
+
+// fakeReceiver stores each stream as a file named after its content.
+type fakeReceiver struct{}
+
+func (f fakeReceiver) Receive(dest string) exec.Cmd {
+	return exec.Cmd{Name: "sh", Args: []string{"-c", `read n && echo "$n" > "$0/$n"`, dest}}
+}
+func (f fakeReceiver) List(dest string) exec.Cmd {
+	return exec.Cmd{Name: "ls", Args: []string{"-1", dest}}
+}
+func (f fakeReceiver) Parse(dest string, out []byte) ([]*snapobj.SnapObj, error) {
+	g := []*snapobj.SnapObj{}
+	for _, l := range strings.Split(string(out), "\n") {
+		if so, err := snapobj.FromString(l); err == nil {
+			g = append(g, so)
+		}
+	}
+	return g, nil
+}
+
+func (f fakeReceiver) Missing(stderr []byte) bool {
+	return strings.Contains(string(stderr), "No such file or directory")
+}
+
+func TestRunStubSSH(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The stub records its arguments and executes the remote command locally.
+	stub := filepath.Join(dir, "ssh")
+	script := "#!/bin/sh\necho \"$@\" >> \"$(dirname \"$0\")/ssh.log\"\nfor last; do :; done\nexec sh -c \"$last\"\n"
+	if err := ioutil.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Replicator{
+		src: &fakeSender{snaps: []*snapobj.SnapObj{
+			sof("hourly@1972-11-07T16:00:00Z"),
+			sof("hourly@1972-11-07T17:00:00Z"),
+		}},
+		recv: fakeReceiver{},
+		target: &Target{
+			Remote: &exec.Remote{Host: "localhost", Command: stub, Options: []string{"-o", "BatchMode=yes"}},
+			Path:   dest,
+		},
+		exec:     &exec.Exec{},
+		compress: "zstd",
+		buffer:   1024,
+	}
+	if _, err := oe.LookPath("zstd"); err != nil {
+		r.compress = ""
+	}
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run() = %v, want nil", err)
+	}
+
+	for _, n := range []string{"hourly@1972-11-07T16:00:00Z", "hourly@1972-11-07T17:00:00Z"} {
+		got, err := ioutil.ReadFile(filepath.Join(dest, n))
+		if err != nil {
+			t.Errorf("replica %s missing: %v", n, err)
+			continue
+		}
+		if string(got) != n+"\n" {
+			t.Errorf("replica %s = %q, want %q", n, got, n+"\n")
+		}
+	}
+	log, err := ioutil.ReadFile(filepath.Join(dir, "ssh.log"))
+	if err != nil || len(log) == 0 {
+		t.Errorf("stub ssh was not invoked: %v", err)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// ls must report missing targets in English.
+	os.Setenv("LC_ALL", "C")
+
+	// A failing ssh must not look like a target which does not exist yet.
+	stub := filepath.Join(dir, "ssh")
+	script := "#!/bin/sh\necho 'ssh: connect to host backup port 22: Connection refused' >&2\nexit 255\n"
+	if err := ioutil.WriteFile(stub, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc    string
+		target  *Target
+		wantErr bool
+	}{
+		{
+			desc:   "missing",
+			target: &Target{Path: filepath.Join(dir, "missing")},
+		},
+		{
+			desc:   "empty",
+			target: &Target{Path: dir},
+		},
+		{
+			desc:    "ssh failure",
+			target:  &Target{Remote: &exec.Remote{Host: "backup", Command: stub}, Path: filepath.Join(dir, "missing")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		r := &Replicator{recv: fakeReceiver{}, target: tt.target, exec: &exec.Exec{Stdout: ioutil.Discard}}
+		got, err := r.remote()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: remote() = _, %v, want error %v", tt.desc, err, tt.wantErr)
+			continue
+		}
+		if len(got) > 0 {
+			t.Errorf("%s: remote() = %v, want no snapshots", tt.desc, got)
+		}
+	}
+}
+
+// fakeResumer keeps the resume token in a file next to the received streams.
+type fakeResumer struct {
+	fakeReceiver
+}
+
+func (f fakeResumer) Receive(dest string) exec.Cmd {
+	return exec.Cmd{Name: "sh", Args: []string{"-c", `read n && echo "$n" > "$0/$n" && rm -f "$0/.token"`, dest}}
+}
+func (f fakeResumer) ResumeToken(dest string) exec.Cmd {
+	return exec.Cmd{Name: "sh", Args: []string{"-c", `cat "$0/.token" 2>/dev/null || echo -`, dest}}
+}
+func (f fakeResumer) ParseResumeToken(out []byte) string {
+	if t := strings.TrimSpace(string(out)); t != "-" {
+		return t
+	}
+	return ""
+}
+func (f fakeResumer) Resume(token string) exec.Cmd {
+	return exec.Cmd{Name: "echo", Args: []string{token}}
+}
+
+func TestResume(t *testing.T) {
+	dest, err := ioutil.TempDir("", "replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	// The token of our fake receiver is the name of the interrupted snapshot.
+	if err := ioutil.WriteFile(filepath.Join(dest, ".token"), []byte("hourly@1972-11-07T15:00:00Z\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Replicator{
+		src: &fakeSender{snaps: []*snapobj.SnapObj{
+			sof("hourly@1972-11-07T15:00:00Z"),
+			sof("hourly@1972-11-07T16:00:00Z"),
+		}},
+		recv:   fakeResumer{},
+		target: &Target{Path: dest},
+		exec:   &exec.Exec{},
+	}
+
+	want := &Status{Target: dest, Pending: 2, ResumeToken: "hourly@1972-11-07T15:00:00Z"}
+	got, err := r.Status()
+	if err != nil {
+		t.Fatalf("Status() = _, %v, want nil", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Status() before Run() mismatch (-want +got)\n%s", diff)
+	}
+
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run() = %v, want nil", err)
+	}
+
+	want = &Status{Target: dest, Latest: "hourly@1972-11-07T16:00:00Z"}
+	got, err = r.Status()
+	if err != nil {
+		t.Fatalf("Status() = _, %v, want nil", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Status() after Run() mismatch (-want +got)\n%s", diff)
+	}
+}
+
+// fakeBookmarker records bookmark operations.
+type fakeBookmarker struct {
+	fakeSender
+	marks   []*snapobj.SnapObj
+	created []string
+	deleted []string
+}
+
+func (f *fakeBookmarker) Bookmarks() ([]*snapobj.SnapObj, error) { return f.marks, nil }
+func (f *fakeBookmarker) Bookmark(s *snapobj.SnapObj) error {
+	f.created = append(f.created, s.FileName())
+	return nil
+}
+func (f *fakeBookmarker) DeleteBookmark(s *snapobj.SnapObj) error {
+	f.deleted = append(f.deleted, s.FileName())
+	return nil
+}
+func (f *fakeBookmarker) SendFromBookmark(base, s *snapobj.SnapObj) exec.Cmd {
+	return exec.Cmd{Name: "echo", Args: []string{s.FileName()}}
+}
+
+func TestUpdateBookmarks(t *testing.T) {
+	fb := &fakeBookmarker{
+		marks: []*snapobj.SnapObj{
+			sof("hourly@1972-11-07T12:00:00Z"),
+			sof("hourly@1972-11-07T13:00:00Z"),
+			sof("hourly@1972-11-07T15:00:00Z"),
+		},
+	}
+	local := []*snapobj.SnapObj{
+		sof("hourly@1972-11-07T15:00:00Z"),
+		sof("hourly@1972-11-07T16:00:00Z"),
+		sof("hourly@1972-11-07T17:00:00Z"),
+		sof("hourly@1972-11-07T18:00:00Z"),
+	}
+	replicated := map[string]bool{
+		"hourly@1972-11-07T15:00:00Z": true,
+		"hourly@1972-11-07T16:00:00Z": true,
+		"hourly@1972-11-07T17:00:00Z": true,
+	}
+
+	r := &Replicator{src: fb, bookmarks: 3}
+	if err := r.updateBookmarks(local, fb.marks, replicated); err != nil {
+		t.Fatalf("updateBookmarks() = %v, want nil", err)
+	}
+	if diff := cmp.Diff([]string{"hourly@1972-11-07T17:00:00Z", "hourly@1972-11-07T16:00:00Z"}, fb.created); diff != "" {
+		t.Errorf("created bookmarks mismatch (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"hourly@1972-11-07T12:00:00Z", "hourly@1972-11-07T13:00:00Z"}, fb.deleted); diff != "" {
+		t.Errorf("deleted bookmarks mismatch (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,57 @@
+package replicate
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/adrian-bl/minisnap/lib/fs/exec"
+)
+
+// Target describes the destination of a replication.
+type Target struct {
+	// Remote is the host executing the receiving side, nil for local targets.
+	Remote *exec.Remote
+	// Path is the dataset or directory to receive into.
+	Path string
+}
+
+// ParseTarget parses a local path or a ssh://[user@]host[:port]/path URL.
+// The leading slash of the URL path is dropped, so 'ssh://host/tank/backup' refers to
+// the dataset 'tank/backup' while 'ssh://host//mnt/backup' refers to the directory '/mnt/backup'.
+func ParseTarget(s string) (*Target, error) {
+	if !strings.HasPrefix(s, "ssh://") {
+		if s == "" {
+			return nil, fmt.Errorf("empty replication target")
+		}
+		return &Target{Path: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	t := &Target{
+		Remote: &exec.Remote{
+			Host: u.Hostname(),
+			Port: u.Port(),
+			User: u.User.Username(),
+		},
+		Path: strings.TrimPrefix(u.Path, "/"),
+	}
+	if t.Remote.Host == "" {
+		return nil, fmt.Errorf("no host in replication target '%s'", s)
+	}
+	if t.Path == "" {
+		return nil, fmt.Errorf("no path in replication target '%s'", s)
+	}
+	return t, nil
+}
+
+// String returns a human readable version of the target.
+func (t *Target) String() string {
+	if t.Remote == nil {
+		return t.Path
+	}
+	return fmt.Sprintf("%s:%s", t.Remote.Destination(), t.Path)
+}
@@ -0,0 +1,247 @@
+// Package s3 implements the subset of the S3 API required to store archives
+// on S3-compatible object stores such as MinIO.
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+	now       func() time.Time
+}
+
+// Part describes an uploaded part of a multipart upload.
+type Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// Error is returned for requests rejected by the server.
+type Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// IsNotFound returns true if err indicates a missing object or upload.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// New returns a client for the given bucket. Buckets are always addressed path-style,
+// as this is what most self-hosted object stores expect.
+func New(endpoint, region, bucket, accessKey, secretKey string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported endpoint '%s'", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket given")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	c := &Client{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		http:      &http.Client{},
+		now:       time.Now,
+	}
+	return c, nil
+}
+
+// Put stores body as key.
+func (c *Client) Put(key string, body []byte) error {
+	resp, err := c.do("PUT", key, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get returns the content of key.
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes key.
+func (c *Client) Delete(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// CreateMultipartUpload starts a new multipart upload of key and returns its id.
+func (c *Client) CreateMultipartUpload(key string) (string, error) {
+	resp, err := c.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	r := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err := xml.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	if r.UploadID == "" {
+		return "", fmt.Errorf("s3: no upload id returned")
+	}
+	return r.UploadID, nil
+}
+
+// UploadPart uploads part n of a multipart upload and returns its ETag.
+func (c *Client) UploadPart(key, id string, n int, body []byte) (string, error) {
+	resp, err := c.do("PUT", key, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {id}}, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// ListParts returns all parts uploaded so far.
+func (c *Client) ListParts(key, id string) ([]Part, error) {
+	parts := []Part{}
+	marker := ""
+	for {
+		q := url.Values{"uploadId": {id}}
+		if marker != "" {
+			q.Set("part-number-marker", marker)
+		}
+		resp, err := c.do("GET", key, q, nil)
+		if err != nil {
+			return nil, err
+		}
+		r := struct {
+			Parts       []Part `xml:"Part"`
+			IsTruncated bool   `xml:"IsTruncated"`
+			NextMarker  string `xml:"NextPartNumberMarker"`
+		}{}
+		err = xml.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, r.Parts...)
+		if !r.IsTruncated || r.NextMarker == "" {
+			return parts, nil
+		}
+		marker = r.NextMarker
+	}
+}
+
+// CompleteMultipartUpload assembles the given parts into the final object.
+func (c *Client) CompleteMultipartUpload(key, id string, parts []Part) error {
+	r := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []Part   `xml:"Part"`
+	}{Parts: parts}
+	body, err := xml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("POST", key, url.Values{"uploadId": {id}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Errors may be reported with a 200 status once the response started.
+	pl, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(pl, []byte("<Error>")) {
+		e := &Error{Status: resp.StatusCode}
+		xml.Unmarshal(pl, e)
+		return e
+	}
+	return nil
+}
+
+// AbortMultipartUpload discards a multipart upload and all of its parts.
+func (c *Client) AbortMultipartUpload(key, id string) error {
+	resp, err := c.do("DELETE", key, url.Values{"uploadId": {id}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// String returns a human readable description of the bucket.
+func (c *Client) String() string {
+	return fmt.Sprintf("s3://%s/%s", c.endpoint.Host, c.bucket)
+}
+
+// do executes a signed request against key.
+func (c *Client) do(method, key string, q url.Values, body []byte) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + strings.TrimPrefix(key, "/")
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(q)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	ph := emptySHA256
+	if len(body) > 0 {
+		h := sha256.Sum256(body)
+		ph = hex.EncodeToString(h[:])
+	}
+	sign(req, c.accessKey, c.secretKey, c.region, ph, c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		e := &Error{Status: resp.StatusCode}
+		pl, _ := ioutil.ReadAll(resp.Body)
+		if err := xml.Unmarshal(pl, e); err != nil {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, e
+	}
+	return resp, nil
+}
@@ -0,0 +1,102 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDate       = "20060102T150405Z"
+	emptySHA256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	signAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// sign adds an AWS signature version 4 to req.
+// All headers present in req at this point are signed, in addition to the host.
+func sign(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	ts := now.UTC().Format(amzDate)
+	req.Header.Set("X-Amz-Date", ts)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	hdrs := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		hdrs[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(hdrs))
+	for k := range hdrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonHdrs := ""
+	for _, k := range names {
+		canonHdrs += k + ":" + hdrs[k] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonHdrs,
+		signed,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", ts[:8], region)
+	sts := strings.Join([]string{signAlgorithm, ts, scope, hexSHA256([]byte(creq))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), ts[:8])
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, sts))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", signAlgorithm, accessKey, scope, signed, sig))
+}
+
+// canonicalQuery returns the query parameters sorted and encoded as required by the signature.
+func canonicalQuery(q map[string][]string) string {
+	p := []string{}
+	for k, vs := range q {
+		for _, v := range vs {
+			p = append(p, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(p)
+	return strings.Join(p, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, keeping slashes unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
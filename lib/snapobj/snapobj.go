@@ -16,11 +16,77 @@ const (
 	Weekly   = 86400 * 7
 	Monthly  = 2592000
 	Yearly   = 86400 * 360
+	// Manual snapshots are created on demand and carry a label, they are not part of any schedule.
+	Manual = -1
 )
 
 type SnapObj struct {
 	Epoch time.Time
 	Type  Type
+	// Label names a manual snapshot.
+	Label string
+	// Expires is the time after which a manual snapshot is deleted, it is kept forever if zero.
+	Expires time.Time
+	// Meta holds optional metadata keyed by the Meta* constants, such as the creator or a note.
+	// Unlike the other fields, it is not part of the name.
+	Meta map[string]string
+	// Source is the name of an adopted snapshot, which was created by another tool or named before the
+	// naming template of its volume changed. It is empty for all other snapshots.
+	// Filesystems refer to adopted snapshots by this name until they are migrated to their own name.
+	Source string
+}
+
+// Keys of SnapObj.Meta.
+const (
+	MetaCreator  = "creator"
+	MetaHostname = "hostname"
+	MetaVersion  = "version"
+	MetaNote     = "note"
+	MetaCommand  = "command"
+	MetaPair     = "pair"
+)
+
+// MetaKeys lists the keys of SnapObj.Meta stored by filesystems.
+var MetaKeys = []string{MetaCreator, MetaHostname, MetaVersion, MetaNote, MetaCommand, MetaPair}
+
+// MaxMetaLen is the maximum length of a metadata value in bytes.
+const MaxMetaLen = 1024
+
+// ValidMeta returns an error if v can not be stored as a metadata value.
+func ValidMeta(v string) error {
+	if strings.ContainsAny(v, "\t\n") {
+		return fmt.Errorf("tabs and newlines are not supported")
+	}
+	if len(v) > MaxMetaLen {
+		return fmt.Errorf("longer than %d bytes", MaxMetaLen)
+	}
+	return nil
+}
+
+// NewManual returns a manual snapshot created at now. If ttl is positive, it expires once it is ttl old.
+func NewManual(label string, now time.Time, ttl time.Duration) (*SnapObj, error) {
+	if err := ValidLabel(label); err != nil {
+		return nil, err
+	}
+	so := &SnapObj{Type: Manual, Epoch: now.UTC().Truncate(time.Second), Label: label}
+	if ttl > 0 {
+		so.Expires = so.Epoch.Add(ttl)
+	}
+	return so, nil
+}
+
+// ValidLabel returns an error if l can not be used as the label of a manual snapshot.
+func ValidLabel(l string) error {
+	if l == "" {
+		return fmt.Errorf("empty label")
+	}
+	for _, c := range l {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+		if !ok {
+			return fmt.Errorf("invalid character '%c' in label '%s'", c, l)
+		}
+	}
+	return nil
 }
 
 // FromFileInfo returns a snap object from a os.FileInfo.
@@ -31,9 +97,12 @@ func FromFileInfo(fi os.FileInfo) (*SnapObj, error) {
 	return FromString(fi.Name())
 }
 
-// FromString returns a snap object from a bare string.
+// FromString returns a snap object from a bare string, as returned by FileName.
 func FromString(s string) (*SnapObj, error) {
 	parts := strings.Split(s, "@")
+	if parts[0] == "manual" {
+		return manualFromString(parts)
+	}
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("invalid format")
 	}
@@ -52,9 +121,51 @@ func FromString(s string) (*SnapObj, error) {
 	}, nil
 }
 
-// FileName returns the file basename to use.
+// manualFromString returns a manual snap object from the '@' separated parts of its name.
+func manualFromString(parts []string) (*SnapObj, error) {
+	if len(parts) != 3 && len(parts) != 4 {
+		return nil, fmt.Errorf("invalid format")
+	}
+	xtime, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidLabel(parts[2]); err != nil {
+		return nil, err
+	}
+	so := &SnapObj{
+		Type:  Manual,
+		Epoch: xtime.UTC(),
+		Label: parts[2],
+	}
+	if len(parts) == 4 {
+		exp, err := time.Parse(time.RFC3339, parts[3])
+		if err != nil {
+			return nil, err
+		}
+		so.Expires = exp.UTC()
+	}
+	return so, nil
+}
+
+// FileName returns the default name of the snapshot, which identifies it regardless of the naming
+// template of its volume, e.g. in replicas and archives.
+// Manual snapshots append their label and, if set, their expiry: 'manual@<time>@<label>[@<expiry>]'.
 func (so SnapObj) FileName() string {
-	return fmt.Sprintf("%s@%s", so.Type.String(), so.Epoch.UTC().Format(time.RFC3339))
+	n := fmt.Sprintf("%s@%s", so.Type.String(), so.Epoch.UTC().Format(time.RFC3339))
+	if so.Type != Manual {
+		return n
+	}
+	n += "@" + so.Label
+	if !so.Expires.IsZero() {
+		n += "@" + so.Expires.UTC().Format(time.RFC3339)
+	}
+	return n
+}
+
+// Adopted returns true if the snapshot is not named the way its volume names snapshots.
+func (so SnapObj) Adopted() bool {
+	return so.Source != ""
 }
 
 // SameType returns true if the compared snap objects are of the same snapshot type.
@@ -82,12 +193,14 @@ func (t Type) String() string {
 		return "monthly"
 	case Yearly:
 		return "yearly"
+	case Manual:
+		return "manual"
 	default:
 		return fmt.Sprintf("uk-%d", t)
 	}
 }
 
-// ToType takes a string and returns a matching Type.
+// ToType takes a string and returns a matching Type. Manual is not accepted, as it can not be scheduled.
 func ToType(s string) (Type, error) {
 	switch s {
 	case "minutely":
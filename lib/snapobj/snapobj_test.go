@@ -211,3 +211,69 @@ func TestIsCurrent(t *testing.T) {
 		}
 	}
 }
+
+func TestManual(t *testing.T) {
+	input := []struct {
+		name    string
+		label   string
+		ttl     time.Duration
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "expiring",
+			label: "pre-upgrade",
+			ttl:   14 * 24 * time.Hour,
+			want:  "manual@1997-01-17T16:54:13Z@pre-upgrade@1997-01-31T16:54:13Z",
+		},
+		{
+			name:  "forever",
+			label: "v1.2_release",
+			want:  "manual@1997-01-17T16:54:13Z@v1.2_release",
+		},
+		{
+			name:    "empty label",
+			wantErr: true,
+		},
+		{
+			name:    "separator in label",
+			label:   "pre@upgrade",
+			wantErr: true,
+		},
+	}
+
+	now := time.Unix(853520053, 500)
+	for _, tt := range input {
+		so, err := NewManual(tt.label, now, tt.ttl)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NewManual(%s) = _, nil, wanted err", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("NewManual(%s) = _, %v, wanted nil", tt.name, err)
+		}
+		if got := so.FileName(); got != tt.want {
+			t.Errorf("NewManual(%s).FileName() = %s, want %s", tt.name, got, tt.want)
+		}
+		got, err := FromString(tt.want)
+		if err != nil {
+			t.Errorf("FromString(%s) = _, %v, wanted nil", tt.want, err)
+		}
+		if diff := cmp.Diff(so, got); diff != "" {
+			t.Errorf("FromString(%s) mismatch (-want +got)\n%s", tt.want, diff)
+		}
+	}
+
+	for _, s := range []string{
+		"manual@1997-01-17T16:54:13Z",
+		"manual@1997-01-17T16:54:13Z@a@b@c",
+		"manual@1997-01-17T16:54:13Z@label@tomorrow",
+		"daily@1997-01-17T16:54:13Z@label",
+	} {
+		if _, err := FromString(s); err == nil {
+			t.Errorf("FromString(%s) = _, nil, wanted err", s)
+		}
+	}
+}
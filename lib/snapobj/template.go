@@ -0,0 +1,307 @@
+package snapobj
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Template describes how snapshots are named, e.g. '{type}-{2006-01-02_1504}'.
+//
+// '{type}' is replaced by the snapshot type. The time of the snapshot is written in UTC using a layout
+// made of the elements 2006, 01, 02, 15, 04 and 05 of Go's reference time, separated by '-', '_', '.'
+// or 'T'. The layout must contain the date, and finer elements require all coarser ones. Other text
+// may only use letters, digits, '-', '_' and '.', so names never contain colons.
+//
+// Manual snapshots append '_<label>_<expiry>', where the expiry uses the same layout or is 'never'.
+//
+// A nil template names snapshots using SnapObj.FileName.
+type Template struct {
+	src string
+	// parts are the literal text and fields of the template, in order.
+	parts []tmplPart
+	// elems is the time layout.
+	elems []layoutElem
+	re    *regexp.Regexp
+	res   time.Duration
+}
+
+// tmplPart is a part of a template: literal text, or the type or time field.
+type tmplPart struct {
+	text  string
+	field string
+}
+
+const (
+	fieldType = "type"
+	fieldTime = "time"
+)
+
+// layoutElem is an element of a time layout, or a separator if unit is 0.
+type layoutElem struct {
+	text string
+	unit time.Duration
+}
+
+// Units of the layout elements. Months and years are never the finest element, as the day is required.
+const (
+	unitYear  = 366 * 24 * time.Hour
+	unitMonth = 31 * 24 * time.Hour
+	unitDay   = 24 * time.Hour
+)
+
+var layoutElems = []layoutElem{
+	{"2006", unitYear}, {"01", unitMonth}, {"02", unitDay}, {"15", time.Hour}, {"04", time.Minute}, {"05", time.Second},
+}
+
+// neverExpires is written instead of the expiry of manual snapshots which are kept forever.
+const neverExpires = "never"
+
+// ParseTemplate parses a naming template as described by Template.
+func ParseTemplate(s string) (*Template, error) {
+	t := &Template{src: s}
+	re := "^"
+	rest := s
+	for len(rest) > 0 {
+		i := strings.IndexByte(rest, '{')
+		if i != 0 {
+			if i < 0 {
+				i = len(rest)
+			}
+			lit := rest[:i]
+			for _, c := range lit {
+				if !validNameChar(c) {
+					return nil, fmt.Errorf("invalid character '%c' in template '%s'", c, s)
+				}
+			}
+			t.parts = append(t.parts, tmplPart{text: lit})
+			re += regexp.QuoteMeta(lit)
+			rest = rest[i:]
+			continue
+		}
+		j := strings.IndexByte(rest, '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unterminated '{' in template '%s'", s)
+		}
+		f := rest[1:j]
+		rest = rest[j+1:]
+		if f == fieldType {
+			if t.has(fieldType) {
+				return nil, fmt.Errorf("template '%s' contains {type} multiple times", s)
+			}
+			t.parts = append(t.parts, tmplPart{field: fieldType})
+			re += `(?P<type>minutely|hourly|daily|weekly|monthly|yearly|manual)`
+			continue
+		}
+		if t.has(fieldTime) {
+			return nil, fmt.Errorf("template '%s' contains multiple times", s)
+		}
+		if err := t.parseLayout(f); err != nil {
+			return nil, fmt.Errorf("template '%s': %v", s, err)
+		}
+		t.parts = append(t.parts, tmplPart{field: fieldTime})
+		re += `(?P<time>` + t.timePattern() + `)`
+	}
+	if !t.has(fieldType) {
+		return nil, fmt.Errorf("template '%s' lacks {type}", s)
+	}
+	if !t.has(fieldTime) {
+		return nil, fmt.Errorf("template '%s' lacks a time, e.g. {2006-01-02_1504}", s)
+	}
+	re += fmt.Sprintf(`(?:_(?P<label>[A-Za-z0-9._-]+)_(?P<expires>%s|%s))?$`, neverExpires, t.timePattern())
+	t.re = regexp.MustCompile(re)
+	return t, nil
+}
+
+// validNameChar returns true if c may be used in the literal text of a template.
+func validNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+}
+
+// has returns true if the template contains the field f.
+func (t *Template) has(f string) bool {
+	for _, p := range t.parts {
+		if p.field == f {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLayout splits the time layout l into its elements.
+func (t *Template) parseLayout(l string) error {
+	seen := make(map[string]bool)
+	for len(l) > 0 {
+		var e layoutElem
+		for _, le := range layoutElems {
+			if strings.HasPrefix(l, le.text) {
+				e = le
+				break
+			}
+		}
+		if e.unit == 0 {
+			if !strings.ContainsAny(l[:1], "-_.T") {
+				return fmt.Errorf("unsupported time layout element at '%s'", l)
+			}
+			e.text = l[:1]
+		} else if seen[e.text] {
+			return fmt.Errorf("time layout contains %s multiple times", e.text)
+		}
+		seen[e.text] = true
+		t.elems = append(t.elems, e)
+		l = l[len(e.text):]
+	}
+	for i, le := range layoutElems {
+		switch {
+		case seen[le.text]:
+			t.res = le.unit
+		case i < 3:
+			return fmt.Errorf("time layout lacks %s", le.text)
+		case i+1 < len(layoutElems) && seen[layoutElems[i+1].text]:
+			return fmt.Errorf("time layout has %s, but lacks %s", layoutElems[i+1].text, le.text)
+		}
+	}
+	return nil
+}
+
+// timePattern returns a regular expression matching the times written by the layout.
+func (t *Template) timePattern() string {
+	var re string
+	for _, e := range t.elems {
+		if e.unit == 0 {
+			re += regexp.QuoteMeta(e.text)
+		} else {
+			re += fmt.Sprintf(`\d{%d}`, len(e.text))
+		}
+	}
+	return re
+}
+
+// String returns the template as given to ParseTemplate.
+func (t *Template) String() string {
+	return t.src
+}
+
+// Resolution returns the unit of the finest element of the time layout. Snapshots of a type shorter than
+// this can not be told apart.
+func (t *Template) Resolution() time.Duration {
+	return t.res
+}
+
+// Format returns the name of so. Its times are truncated to the resolution of the template.
+func (t *Template) Format(so *SnapObj) string {
+	if t == nil {
+		return so.FileName()
+	}
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.field {
+		case fieldType:
+			b.WriteString(so.Type.String())
+		case fieldTime:
+			b.WriteString(t.formatTime(so.Epoch))
+		default:
+			b.WriteString(p.text)
+		}
+	}
+	if so.Type == Manual {
+		exp := neverExpires
+		if !so.Expires.IsZero() {
+			exp = t.formatTime(so.Expires)
+		}
+		fmt.Fprintf(&b, "_%s_%s", so.Label, exp)
+	}
+	return b.String()
+}
+
+// formatTime writes ts in UTC using the layout.
+func (t *Template) formatTime(ts time.Time) string {
+	ts = ts.UTC()
+	var b strings.Builder
+	for _, e := range t.elems {
+		switch e.unit {
+		case 0:
+			b.WriteString(e.text)
+		case unitYear:
+			fmt.Fprintf(&b, "%04d", ts.Year())
+		case unitMonth:
+			fmt.Fprintf(&b, "%02d", int(ts.Month()))
+		case unitDay:
+			fmt.Fprintf(&b, "%02d", ts.Day())
+		case time.Hour:
+			fmt.Fprintf(&b, "%02d", ts.Hour())
+		case time.Minute:
+			fmt.Fprintf(&b, "%02d", ts.Minute())
+		case time.Second:
+			fmt.Fprintf(&b, "%02d", ts.Second())
+		}
+	}
+	return b.String()
+}
+
+// parseTime converts a time written by formatTime back into a time, rejecting out of range elements.
+func (t *Template) parseTime(s string) (time.Time, error) {
+	v := map[time.Duration]int{unitMonth: 1, unitDay: 1}
+	for _, e := range t.elems {
+		n := s[:len(e.text)]
+		s = s[len(e.text):]
+		if e.unit == 0 {
+			continue
+		}
+		x, err := strconv.Atoi(n)
+		if err != nil {
+			return time.Time{}, err
+		}
+		v[e.unit] = x
+	}
+	ts := time.Date(v[unitYear], time.Month(v[unitMonth]), v[unitDay], v[time.Hour], v[time.Minute], v[time.Second], 0, time.UTC)
+	// time.Date normalizes out of range values, e.g. February 30th into March.
+	if int(ts.Month()) != v[unitMonth] || ts.Day() != v[unitDay] || ts.Hour() != v[time.Hour] ||
+		ts.Minute() != v[time.Minute] || ts.Second() != v[time.Second] {
+		return time.Time{}, fmt.Errorf("time out of range")
+	}
+	return ts, nil
+}
+
+// Parse converts a name written by Format back into a snap object.
+func (t *Template) Parse(name string) (*SnapObj, error) {
+	if t == nil {
+		return FromString(name)
+	}
+	m := t.re.FindStringSubmatch(name)
+	if m == nil {
+		return nil, fmt.Errorf("invalid format")
+	}
+	g := make(map[string]string)
+	for i, n := range t.re.SubexpNames() {
+		g[n] = m[i]
+	}
+
+	so := &SnapObj{Type: Manual}
+	if g[fieldType] != Type(Manual).String() {
+		st, err := ToType(g[fieldType])
+		if err != nil {
+			return nil, err
+		}
+		so.Type = st
+	}
+	if (so.Type == Manual) != (g["label"] != "") {
+		return nil, fmt.Errorf("invalid format")
+	}
+	var err error
+	if so.Epoch, err = t.parseTime(g[fieldTime]); err != nil {
+		return nil, err
+	}
+	if so.Type != Manual {
+		return so, nil
+	}
+	so.Label = g["label"]
+	if g["expires"] != neverExpires {
+		if so.Expires, err = t.parseTime(g["expires"]); err != nil {
+			return nil, err
+		}
+	}
+	return so, nil
+}
@@ -0,0 +1,93 @@
+//go:build go1.18
+// +build go1.18
+
+// Fuzz targets require Go 1.18, while the module supports older versions.
+
+package snapobj
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var fuzzTemplates = []string{
+	"{type}-{2006-01-02_1504}",
+	"{2006-01-02T150405}.{type}",
+	"snap_{type}_{20060102}",
+	"{type}{2006010215}",
+}
+
+// FuzzTemplateFormat checks that every snapshot survives formatting and parsing, except for the
+// truncation of its times.
+func FuzzTemplateFormat(f *testing.F) {
+	for _, tmpl := range fuzzTemplates {
+		f.Add(tmpl, int64(853520053), uint8(0), "", int64(0))
+		f.Add(tmpl, int64(853520053), uint8(6), "pre-upgrade", int64(86400))
+		f.Add(tmpl, int64(-62167219200), uint8(6), "a_never", int64(0))
+	}
+	types := []Type{Minutely, Hourly, Daily, Weekly, Monthly, Yearly, Manual}
+	// Times from year 0 to 9999, as years are written with four digits.
+	const minUnix, maxUnix = -62167219200, 253402300799
+	f.Fuzz(func(t *testing.T, s string, unix int64, typ uint8, label string, ttl int64) {
+		tmpl, err := ParseTemplate(s)
+		if err != nil {
+			return
+		}
+		so := &SnapObj{Type: types[int(typ)%len(types)], Epoch: time.Unix(unix, 0).UTC()}
+		if unix < minUnix || unix > maxUnix {
+			return
+		}
+		if so.Type == Manual {
+			if ValidLabel(label) != nil {
+				return
+			}
+			so.Label = label
+			if ttl > 0 && ttl <= maxUnix-unix {
+				so.Expires = time.Unix(unix+ttl, 0).UTC()
+			}
+		}
+
+		name := tmpl.Format(so)
+		if strings.ContainsAny(name, ":@/") {
+			t.Errorf("Format(%s) = %s, contains reserved characters", s, name)
+		}
+		got, err := tmpl.Parse(name)
+		if err != nil {
+			t.Fatalf("Parse(%s) = _, %v, want nil (template %s)", name, err, s)
+		}
+		want := *so
+		want.Epoch = so.Epoch.Truncate(tmpl.Resolution())
+		if !so.Expires.IsZero() {
+			want.Expires = so.Expires.Truncate(tmpl.Resolution())
+		}
+		if diff := cmp.Diff(&want, got); diff != "" {
+			t.Errorf("Parse(Format()) mismatch for template %s (-want +got)\n%s", s, diff)
+		}
+	})
+}
+
+// FuzzTemplateParse checks that names are only accepted if formatting the parsed snapshot returns them,
+// so that no two snapshots share a name.
+func FuzzTemplateParse(f *testing.F) {
+	for _, tmpl := range fuzzTemplates {
+		f.Add(tmpl, "daily-1997-01-17_1654")
+		f.Add(tmpl, "manual-1997-01-17_1654_x_y_never")
+		f.Add(tmpl, "1997-01-17T165413.manual_a_1997-01-31T165413")
+	}
+	f.Fuzz(func(t *testing.T, s, name string) {
+		tmpl, err := ParseTemplate(s)
+		if err != nil {
+			return
+		}
+		so, err := tmpl.Parse(name)
+		if err != nil {
+			return
+		}
+		if got := tmpl.Format(so); got != name {
+			t.Errorf("Format(Parse(%s)) = %s, want %s (template %s)", name, got, name, s)
+		}
+	})
+}
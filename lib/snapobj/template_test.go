@@ -0,0 +1,126 @@
+package snapobj
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTemplate(t *testing.T) {
+	input := []struct {
+		tmpl    string
+		wantRes time.Duration
+		wantErr bool
+	}{
+		{tmpl: "{type}-{2006-01-02_1504}", wantRes: time.Minute},
+		{tmpl: "{2006-01-02T150405}.{type}", wantRes: time.Second},
+		{tmpl: "snap_{type}_{20060102}", wantRes: 24 * time.Hour},
+		{tmpl: "{type}-{2006-01-02_15}", wantRes: time.Hour},
+		{tmpl: "{type}", wantErr: true},
+		{tmpl: "{2006-01-02}", wantErr: true},
+		{tmpl: "{type}-{type}-{2006-01-02}", wantErr: true},
+		{tmpl: "{type}-{2006-01-02}-{2006-01-02}", wantErr: true},
+		{tmpl: "{type}@{2006-01-02}", wantErr: true},
+		{tmpl: "{type}-{2006-01-02 15:04}", wantErr: true},
+		{tmpl: "{type}-{2006-01}", wantErr: true},
+		{tmpl: "{type}-{2006-01-02_04}", wantErr: true},
+		{tmpl: "{type}-{2006-01-02_0102}", wantErr: true},
+		{tmpl: "{type}-{Jan 2 2006}", wantErr: true},
+		{tmpl: "{type}-{2006-01-02", wantErr: true},
+		{tmpl: "{type}-{2006-01-02}}", wantErr: true},
+	}
+	for _, tt := range input {
+		got, err := ParseTemplate(tt.tmpl)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTemplate(%s) = _, %v, want error %v", tt.tmpl, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.Resolution() != tt.wantRes {
+			t.Errorf("ParseTemplate(%s).Resolution() = %v, want %v", tt.tmpl, got.Resolution(), tt.wantRes)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	epoch := time.Unix(853520053, 0).UTC()
+	input := []struct {
+		tmpl string
+		so   *SnapObj
+		want string
+		// parsed is the snapshot returned when parsing want, so truncated to the template.
+		parsed *SnapObj
+	}{
+		{
+			tmpl:   "{type}-{2006-01-02_1504}",
+			so:     &SnapObj{Type: Daily, Epoch: epoch},
+			want:   "daily-1997-01-17_1654",
+			parsed: &SnapObj{Type: Daily, Epoch: time.Unix(853520040, 0).UTC()},
+		},
+		{
+			tmpl:   "{2006-01-02T150405}.{type}",
+			so:     &SnapObj{Type: Hourly, Epoch: epoch},
+			want:   "1997-01-17T165413.hourly",
+			parsed: &SnapObj{Type: Hourly, Epoch: epoch},
+		},
+		{
+			tmpl:   "{type}-{2006-01-02_1504}",
+			so:     &SnapObj{Type: Manual, Epoch: epoch, Label: "pre_upgrade"},
+			want:   "manual-1997-01-17_1654_pre_upgrade_never",
+			parsed: &SnapObj{Type: Manual, Epoch: time.Unix(853520040, 0).UTC(), Label: "pre_upgrade"},
+		},
+		{
+			tmpl:   "{type}-{2006-01-02_1504}",
+			so:     &SnapObj{Type: Manual, Epoch: epoch, Label: "x", Expires: epoch.Add(14 * 24 * time.Hour)},
+			want:   "manual-1997-01-17_1654_x_1997-01-31_1654",
+			parsed: &SnapObj{Type: Manual, Epoch: time.Unix(853520040, 0).UTC(), Label: "x", Expires: time.Unix(853520040+14*86400, 0).UTC()},
+		},
+		{
+			tmpl:   "",
+			so:     &SnapObj{Type: Daily, Epoch: epoch},
+			want:   "daily@1997-01-17T16:54:13Z",
+			parsed: &SnapObj{Type: Daily, Epoch: epoch},
+		},
+	}
+	for _, tt := range input {
+		var tmpl *Template
+		if tt.tmpl != "" {
+			var err error
+			if tmpl, err = ParseTemplate(tt.tmpl); err != nil {
+				t.Fatalf("ParseTemplate(%s) = _, %v, want nil", tt.tmpl, err)
+			}
+		}
+		got := tmpl.Format(tt.so)
+		if got != tt.want {
+			t.Errorf("Format(%s) = %s, want %s", tt.tmpl, got, tt.want)
+		}
+		parsed, err := tmpl.Parse(tt.want)
+		if err != nil {
+			t.Errorf("Parse(%s) = _, %v, want nil", tt.want, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.parsed, parsed); diff != "" {
+			t.Errorf("Parse(%s) mismatch (-want +got)\n%s", tt.want, diff)
+		}
+	}
+}
+
+func TestTemplateParseInvalid(t *testing.T) {
+	tmpl, err := ParseTemplate("{type}-{2006-01-02_1504}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{
+		"daily-1997-02-30_1654",
+		"daily-1997-01-17_2460",
+		"daily-1997-01-17_1654_x_never",
+		"manual-1997-01-17_1654",
+		"manual-1997-01-17_1654_x_tomorrow",
+		"daily@1997-01-17T16:54:13Z",
+		"fortnightly-1997-01-17_1654",
+	} {
+		if so, err := tmpl.Parse(n); err == nil {
+			t.Errorf("Parse(%s) = %v, nil, want error", n, so)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package stream
+
+import (
+	"io"
+	"sync"
+)
+
+// chunkSize is the size of a single read issued by a Buffer.
+const chunkSize = 128 * 1024
+
+type chunk struct {
+	b   []byte
+	err error
+}
+
+// Buffer reads ahead from an io.Reader in the background, similar to mbuffer(1).
+// This decouples a bursty producer (such as 'zfs send') from a slow consumer (such as ssh).
+type Buffer struct {
+	c    chan chunk
+	done chan struct{}
+	once sync.Once
+	cur  chunk
+}
+
+// NewBuffer returns a buffer holding up to size bytes read from r.
+func NewBuffer(r io.Reader, size int64) *Buffer {
+	n := int(size / chunkSize)
+	if n < 1 {
+		n = 1
+	}
+	b := &Buffer{
+		c:    make(chan chunk, n),
+		done: make(chan struct{}),
+	}
+	go b.fill(r)
+	return b
+}
+
+func (b *Buffer) fill(r io.Reader) {
+	for {
+		p := make([]byte, chunkSize)
+		n, err := io.ReadFull(r, p)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case b.c <- chunk{b: p[:n], err: err}:
+		case <-b.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *Buffer) Read(p []byte) (int, error) {
+	for len(b.cur.b) == 0 {
+		if b.cur.err != nil {
+			return 0, b.cur.err
+		}
+		b.cur = <-b.c
+	}
+	n := copy(p, b.cur.b)
+	b.cur.b = b.cur.b[n:]
+	return n, nil
+}
+
+// Close stops the background reader. Data which was not consumed yet is lost.
+func (b *Buffer) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return nil
+}
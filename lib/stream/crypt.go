@@ -0,0 +1,197 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Encrypted streams start with cryptMagic and a random salt, followed by segments of up to
+// segmentSize bytes sealed with AES-256-GCM. Each stream uses its own key derived from the
+// master key and the salt, which allows using the segment number as nonce.
+// The last segment is flagged, so truncated streams are detected.
+const (
+	cryptMagic  = "MSNAPENC1"
+	saltSize    = 16
+	segmentSize = 64 * 1024
+)
+
+// SaltSize is the size of the salt passed to NewEncrypter.
+const SaltSize = saltSize
+
+// ReadKey reads a 256 bit key from path, stored either raw or hex encoded.
+func ReadKey(path string) ([]byte, error) {
+	pl, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(pl) == 32 {
+		return pl, nil
+	}
+	k, err := hex.DecodeString(string(bytes.TrimSpace(pl)))
+	if err != nil || len(k) != 32 {
+		return nil, fmt.Errorf("%s: key must be 32 raw or 64 hex encoded bytes", path)
+	}
+	return k, nil
+}
+
+type crypter struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	seq   uint64
+	buf   []byte
+	out   []byte
+	final bool
+	err   error
+}
+
+// NewEncrypter returns a reader returning the encrypted content of r.
+// The output only depends on r, key and salt: encrypting the same data with the same salt
+// yields the same stream, which allows resuming interrupted uploads.
+func NewEncrypter(r io.Reader, key, salt []byte) (io.Reader, error) {
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("salt must be %d bytes", saltSize)
+	}
+	aead, err := streamCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	c := &crypter{
+		r:    bufio.NewReaderSize(r, segmentSize),
+		aead: aead,
+		buf:  make([]byte, segmentSize),
+		out:  append([]byte(cryptMagic), salt...),
+	}
+	return readerFunc(c.encrypt), nil
+}
+
+// NewDecrypter returns a reader returning the decrypted content of r.
+func NewDecrypter(r io.Reader, key []byte) (io.Reader, error) {
+	hdr := make([]byte, len(cryptMagic)+saltSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %v", err)
+	}
+	if string(hdr[:len(cryptMagic)]) != cryptMagic {
+		return nil, fmt.Errorf("not an encrypted stream")
+	}
+	aead, err := streamCipher(key, hdr[len(cryptMagic):])
+	if err != nil {
+		return nil, err
+	}
+	c := &crypter{
+		r:    bufio.NewReaderSize(r, segmentSize+aead.Overhead()),
+		aead: aead,
+		buf:  make([]byte, segmentSize+aead.Overhead()),
+	}
+	return readerFunc(c.decrypt), nil
+}
+
+func (c *crypter) encrypt(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.final || c.err != nil {
+			return 0, c.eof()
+		}
+		n, final, err := c.segment()
+		if err != nil {
+			c.err = err
+			continue
+		}
+		c.out = c.aead.Seal(c.buf[:0:0], c.nonce(), c.buf[:n], c.aad(final))
+		c.final = final
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *crypter) decrypt(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.final || c.err != nil {
+			return 0, c.eof()
+		}
+		n, final, err := c.segment()
+		if err != nil {
+			c.err = err
+			continue
+		}
+		if n < c.aead.Overhead() {
+			c.err = fmt.Errorf("truncated segment %d", c.seq)
+			continue
+		}
+		out, err := c.aead.Open(nil, c.nonce(), c.buf[:n], c.aad(final))
+		if err != nil {
+			c.err = fmt.Errorf("segment %d: %v", c.seq, err)
+			continue
+		}
+		c.out = out
+		c.final = final
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// segment reads the next segment into buf and reports whether it is the last one.
+func (c *crypter) segment() (int, bool, error) {
+	n, err := io.ReadFull(c.r, c.buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if _, err := c.r.Peek(1); err == io.EOF {
+		return n, true, nil
+	}
+	return n, false, nil
+}
+
+func (c *crypter) eof() error {
+	if c.err != nil {
+		return c.err
+	}
+	return io.EOF
+}
+
+// nonce returns the nonce of the next segment.
+func (c *crypter) nonce() []byte {
+	n := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], c.seq)
+	c.seq++
+	return n
+}
+
+func (c *crypter) aad(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// streamCipher returns the cipher of a single stream.
+func streamCipher(key, salt []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes")
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(salt)
+	b, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
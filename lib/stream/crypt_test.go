@@ -0,0 +1,57 @@
+package stream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	salt := bytes.Repeat([]byte{3}, SaltSize)
+
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, 3*segmentSize + 17} {
+		plain := bytes.Repeat([]byte("z"), size)
+
+		enc, err := NewEncrypter(bytes.NewReader(plain), key, salt)
+		if err != nil {
+			t.Fatalf("NewEncrypter() = _, %v, want nil", err)
+		}
+		ct, err := ioutil.ReadAll(enc)
+		if err != nil {
+			t.Fatalf("encrypting %d bytes: %v", size, err)
+		}
+
+		// Encryption must be deterministic for a given salt.
+		enc2, _ := NewEncrypter(bytes.NewReader(plain), key, salt)
+		if ct2, _ := ioutil.ReadAll(enc2); !bytes.Equal(ct, ct2) {
+			t.Errorf("encrypting %d bytes twice yields different streams", size)
+		}
+
+		dec, err := NewDecrypter(bytes.NewReader(ct), key)
+		if err != nil {
+			t.Fatalf("NewDecrypter() = _, %v, want nil", err)
+		}
+		got, err := ioutil.ReadAll(dec)
+		if err != nil {
+			t.Errorf("decrypting %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("decrypting %d bytes returned %d bytes", size, len(got))
+		}
+
+		// Dropping the last segment must be detected.
+		if size > segmentSize {
+			dec, _ := NewDecrypter(bytes.NewReader(ct[:len(ct)-(size%segmentSize)-16]), key)
+			if _, err := ioutil.ReadAll(dec); err == nil {
+				t.Errorf("decrypting truncated stream of %d bytes = nil, wanted err", size)
+			}
+		}
+
+		// So must be the wrong key.
+		dec, _ = NewDecrypter(bytes.NewReader(ct), bytes.Repeat([]byte{8}, 32))
+		if _, err := ioutil.ReadAll(dec); err == nil {
+			t.Errorf("decrypting %d bytes with wrong key = nil, wanted err", size)
+		}
+	}
+}
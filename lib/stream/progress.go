@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Stats describes the progress of a transfer.
+type Stats struct {
+	Bytes int64
+	// Total is the expected size of the transfer, 0 if unknown.
+	Total   int64
+	Elapsed time.Duration
+	// Done is set on the final update.
+	Done bool
+}
+
+// Rate returns the average throughput in bytes per second.
+func (s Stats) Rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// ETA returns the expected remaining time, 0 if unknown.
+func (s Stats) ETA() time.Duration {
+	r := s.Rate()
+	if s.Total <= s.Bytes || r == 0 {
+		return 0
+	}
+	return time.Duration(float64(s.Total-s.Bytes) / r * float64(time.Second)).Round(time.Second)
+}
+
+// String returns a human readable version of the stats.
+func (s Stats) String() string {
+	t := FormatSize(s.Bytes)
+	if s.Total > 0 {
+		t += fmt.Sprintf(" of ~%s (%d%%)", FormatSize(s.Total), s.Bytes*100/s.Total)
+	}
+	t += fmt.Sprintf(", %s/s", FormatSize(int64(s.Rate())))
+	if s.Done {
+		t += fmt.Sprintf(" in %s", s.Elapsed.Round(time.Second))
+	} else if eta := s.ETA(); eta > 0 {
+		t += fmt.Sprintf(", ETA %s", eta)
+	}
+	return t
+}
+
+// Progress counts the bytes read through it and reports them periodically.
+type Progress struct {
+	r        io.Reader
+	fn       func(Stats)
+	interval time.Duration
+	stats    Stats
+	start    time.Time
+	last     time.Time
+	now      func() time.Time
+}
+
+// NewProgress returns a reader calling fn with the current stats at most once per interval.
+// total is the expected size, 0 if unknown.
+func NewProgress(r io.Reader, total int64, interval time.Duration, fn func(Stats)) *Progress {
+	p := &Progress{r: r, fn: fn, interval: interval, now: time.Now}
+	p.stats.Total = total
+	return p
+}
+
+func (p *Progress) Read(b []byte) (int, error) {
+	now := p.now()
+	if p.start.IsZero() {
+		p.start, p.last = now, now
+	}
+	n, err := p.r.Read(b)
+	p.stats.Bytes += int64(n)
+
+	now = p.now()
+	p.stats.Elapsed = now.Sub(p.start)
+	if now.Sub(p.last) >= p.interval {
+		p.last = now
+		p.fn(p.stats)
+	}
+	return n, err
+}
+
+// Stats returns the final stats, once reading is done.
+func (p *Progress) Stats() Stats {
+	s := p.stats
+	s.Done = true
+	return s
+}
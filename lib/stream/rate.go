@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// RateWindow limits the rate during a time of day. Windows may wrap around midnight.
+type RateWindow struct {
+	// From and To are minutes since midnight, From is inclusive, To exclusive.
+	From, To int
+	// Limit is the rate in bytes per second, 0 for unlimited.
+	Limit int64
+}
+
+// RateSchedule returns the rate limit for a given time.
+type RateSchedule struct {
+	// Default applies outside of all windows, 0 for unlimited.
+	Default int64
+	Windows []RateWindow
+}
+
+// ParseRateWindow converts from and to, such as '08:00' and '18:00', and a size such as '5M' into a RateWindow.
+func ParseRateWindow(from, to, limit string) (RateWindow, error) {
+	w := RateWindow{}
+	var err error
+	if w.From, err = parseClock(from); err != nil {
+		return w, err
+	}
+	if w.To, err = parseClock(to); err != nil {
+		return w, err
+	}
+	if w.Limit, err = ParseSize(limit); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s', want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains returns true if minute m of the day is within the window.
+func (w RateWindow) contains(m int) bool {
+	if w.From <= w.To {
+		return m >= w.From && m < w.To
+	}
+	return m >= w.From || m < w.To
+}
+
+// Rate returns the limit in bytes per second at t, using its local time of day. The first matching window wins.
+func (s RateSchedule) Rate(t time.Time) int64 {
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range s.Windows {
+		if w.contains(m) {
+			return w.Limit
+		}
+	}
+	return s.Default
+}
+
+// Limiter throttles reads from an io.Reader to a rate which may change over time.
+type Limiter struct {
+	r      io.Reader
+	rate   func(time.Time) int64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+// NewLimiter returns a reader limiting reads from r to rate(now) bytes per second, 0 meaning unlimited.
+func NewLimiter(r io.Reader, rate func(time.Time) int64) *Limiter {
+	return &Limiter{r: r, rate: rate, now: time.Now, sleep: time.Sleep}
+}
+
+func (l *Limiter) Read(p []byte) (int, error) {
+	now := l.now()
+	rate := l.rate(now)
+	if rate <= 0 {
+		l.last = time.Time{}
+		return l.r.Read(p)
+	}
+
+	// Refill the bucket, allowing bursts of up to a tenth of a second.
+	burst := float64(rate) / 10
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	if max := int(burst); len(p) > max && max > 0 {
+		p = p[:max]
+	}
+	n, err := l.r.Read(p)
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		d := time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+		l.sleep(d)
+		l.tokens = 0
+		l.last = l.last.Add(d)
+	}
+	return n, err
+}
@@ -0,0 +1,81 @@
+package stream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateSchedule(t *testing.T) {
+	day, err := ParseRateWindow("08:00", "18:00", "5M")
+	if err != nil {
+		t.Fatalf("ParseRateWindow() = _, %v, want nil", err)
+	}
+	night, err := ParseRateWindow("22:30", "06:00", "0")
+	if err != nil {
+		t.Fatalf("ParseRateWindow() = _, %v, want nil", err)
+	}
+	s := RateSchedule{Default: 50 << 20, Windows: []RateWindow{day, night}}
+
+	input := []struct {
+		clock string
+		want  int64
+	}{
+		{clock: "07:59", want: 50 << 20},
+		{clock: "08:00", want: 5 << 20},
+		{clock: "17:59", want: 5 << 20},
+		{clock: "18:00", want: 50 << 20},
+		{clock: "23:00", want: 0},
+		{clock: "00:15", want: 0},
+		{clock: "06:00", want: 50 << 20},
+	}
+
+	for _, tt := range input {
+		c, _ := time.Parse("15:04", tt.clock)
+		if got := s.Rate(c); got != tt.want {
+			t.Errorf("Rate(%s) = %d, want %d", tt.clock, got, tt.want)
+		}
+	}
+
+	if _, err := ParseRateWindow("8am", "18:00", "5M"); err == nil {
+		t.Errorf("ParseRateWindow(8am) = _, nil, wanted err")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var slept time.Duration
+
+	data := bytes.Repeat([]byte("x"), 10000)
+	l := NewLimiter(bytes.NewReader(data), func(time.Time) int64 { return 1000 })
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	got, err := ioutil.ReadAll(l)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("ReadAll() = %d bytes, %v, want %d bytes", len(got), err, len(data))
+	}
+	// 10000 bytes at 1000 bytes/s minus the initial burst of 100 bytes.
+	if want := 9900 * time.Millisecond; slept < want-10*time.Millisecond || slept > want+10*time.Millisecond {
+		t.Errorf("Limiter slept %s, want %s", slept, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := Stats{Bytes: 50 << 20, Total: 200 << 20, Elapsed: 10 * time.Second}
+	if got, want := s.ETA(), 30*time.Second; got != want {
+		t.Errorf("ETA() = %s, want %s", got, want)
+	}
+	if got, want := s.String(), "50.0M of ~200.0M (25%), 5.0M/s, ETA 30s"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+
+	s.Total, s.Done = 0, true
+	if got, want := s.String(), "50.0M, 5.0M/s in 10s"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
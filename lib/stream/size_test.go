@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	input := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "0", want: 0},
+		{input: "512", want: 512},
+		{input: "4k", want: 4096},
+		{input: "128M", want: 128 << 20},
+		{input: "1.5G", want: 3 << 29},
+		{input: "2TiB", want: 2 << 40},
+		{input: "10MB", want: 10 << 20},
+		{input: "", wantErr: true},
+		{input: "-1M", wantErr: true},
+		{input: "lots", wantErr: true},
+	}
+
+	for _, tt := range input {
+		got, err := ParseSize(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSize(%s) = %d, nil, wanted err", tt.input, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%s) = %d, %v, want %d, nil", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	input := []struct {
+		input int64
+		want  string
+	}{
+		{input: 12, want: "12B"},
+		{input: 4096, want: "4.0K"},
+		{input: 3 << 29, want: "1.5G"},
+	}
+
+	for _, tt := range input {
+		if got := FormatSize(tt.input); got != tt.want {
+			t.Errorf("FormatSize(%d) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	want := bytes.Repeat([]byte("minisnap"), chunkSize)
+	b := NewBuffer(bytes.NewReader(want), 4*chunkSize)
+	defer b.Close()
+
+	got, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatalf("ReadAll() = _, %v, want nil", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ReadAll() returned %d bytes, want %d", len(got), len(want))
+	}
+}